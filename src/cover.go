@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// --- Coverage ---
+
+// Coverage counts how often each expression of the source that is code was
+// evaluated, and how often each if took its then and its else branch. The
+// expressions are the lists of the program, which the reader notes the
+// Positions of; atoms are not counted. The code of a form is the body of
+// each lambda in it, and the quoted expression of an eval or a try.
+type Coverage struct {
+	BaseHook
+	m        *Machine
+	forms    []coverForm
+	hits     map[int]int    // by expression
+	branches map[int][2]int // by if expression: then and else
+}
+
+// coverForm is a top-level form with the expressions of its code.
+type coverForm struct {
+	name  int // the symbol it defines, or Nil
+	start int
+	exprs []int
+}
+
+// Coverage returns the coverage of m, and starts recording it. From then on
+// the reader notes the Positions of the lists it reads.
+func (m *Machine) Coverage() *Coverage {
+	if m.coverage == nil {
+		if m.Positions == nil {
+			m.Positions = map[int]int{}
+		}
+		c := &Coverage{m: m, hits: map[int]int{}, branches: map[int][2]int{}}
+		m.coverage = c
+		m.AddHook(c)
+	}
+	return m.coverage
+}
+
+// addForm notes the code of the top-level form e, just read.
+func (c *Coverage) addForm(e int) {
+	m := c.m
+	f := coverForm{name: Nil, start: m.formStart}
+	switch head := m.Car(e); {
+	case m.IsAtom(e), m.formCommand:
+	case head == m.SymDefine:
+		f.name = m.Car(m.Cdr(e))
+		def := m.Car(m.Cdr(m.Cdr(e)))
+		if !m.IsAtom(f.name) {
+			f.name = m.Car(f.name)
+			c.code(def, &f)
+		} else if !m.IsAtom(def) && m.Car(def) == m.SymLambda {
+			c.code(m.Car(m.Cdr(m.Cdr(def))), &f)
+		}
+	default:
+		c.code(e, &f)
+	}
+	c.forms = append(c.forms, f)
+}
+
+// code adds the lists of the expression e to the expressions of f.
+func (c *Coverage) code(e int, f *coverForm) {
+	m := c.m
+	if m.IsAtom(e) {
+		return
+	}
+	if _, ok := m.Positions[e]; ok {
+		if _, seen := c.hits[e]; !seen {
+			c.hits[e] = 0
+			f.exprs = append(f.exprs, e)
+		}
+	}
+	head, args := m.Car(e), m.Cdr(e)
+	switch head {
+	case m.SymLambda:
+		c.code(m.Car(m.Cdr(args)), f)
+		return
+	case m.SymQuote:
+		if x := m.Car(args); !m.IsAtom(x) && m.Car(x) == m.SymLambda {
+			c.code(m.Car(m.Cdr(m.Cdr(x))), f)
+		}
+		return
+	case m.SymIf:
+		c.branches[e] = [2]int{}
+	case m.SymEval, m.SymTry:
+		code := args
+		if head == m.SymTry {
+			code = m.Cdr(args)
+		}
+		if x := m.Car(code); !m.IsAtom(x) && m.Car(x) == m.SymQuote {
+			c.code(m.Car(m.Cdr(x)), f)
+		}
+	}
+	for ; !m.IsAtom(e); e = m.Cdr(e) {
+		c.code(m.Car(e), f)
+	}
+}
+
+func (c *Coverage) Enter(e int) {
+	if n, ok := c.hits[e]; ok {
+		c.hits[e] = n + 1
+	}
+}
+
+func (c *Coverage) Branch(e int, then bool) {
+	if b, ok := c.branches[e]; ok {
+		if then {
+			b[0]++
+		} else {
+			b[1]++
+		}
+		c.branches[e] = b
+	}
+}
+
+// CoverageEntry gives the coverage of a top-level form: how many of its
+// expressions were evaluated, and how many of the branches of its ifs were
+// taken.
+type CoverageEntry struct {
+	Name                   string // the symbol it defines, or "" for an expression
+	Line                   int
+	Exprs, ExprsCovered    int
+	Branches, BranchesTook int
+}
+
+// Percent returns the part of the expressions and branches of e that were
+// covered, as a percentage. A form without any is covered.
+func (e CoverageEntry) Percent() float64 {
+	total := e.Exprs + e.Branches
+	if total == 0 {
+		return 100
+	}
+	return 100 * float64(e.ExprsCovered+e.BranchesTook) / float64(total)
+}
+
+// Entries returns the coverage of each define of a function, in the order
+// of the source, followed by that of all top-level expressions together.
+func (c *Coverage) Entries() []CoverageEntry {
+	var entries []CoverageEntry
+	top := CoverageEntry{}
+	for _, f := range c.forms {
+		if len(f.exprs) == 0 {
+			continue
+		}
+		e := &top
+		if f.name != Nil {
+			entries = append(entries, CoverageEntry{Name: c.m.NameString(f.name), Line: c.m.SourceLine(f.start)})
+			e = &entries[len(entries)-1]
+		}
+		for _, x := range f.exprs {
+			e.Exprs++
+			if c.hits[x] > 0 {
+				e.ExprsCovered++
+			}
+			if b, ok := c.branches[x]; ok {
+				e.Branches += 2
+				e.BranchesTook += min(b[0], 1) + min(b[1], 1)
+			}
+		}
+	}
+	if top.Exprs > 0 {
+		entries = append(entries, top)
+	}
+	return entries
+}
+
+// WriteReport writes a table of the coverage of each define to w, with the
+// total of the program at the end.
+func (c *Coverage) WriteReport(w io.Writer) {
+	fmt.Fprintf(w, "%7s %11s %11s  %s\n", "cover", "exprs", "branches", "define")
+	var total CoverageEntry
+	for _, e := range c.Entries() {
+		name := e.Name
+		if name == "" {
+			name = "<top>"
+		} else {
+			name = fmt.Sprintf("%s (line %d)", name, e.Line)
+		}
+		c.writeEntry(w, e, name)
+		total.Exprs += e.Exprs
+		total.ExprsCovered += e.ExprsCovered
+		total.Branches += e.Branches
+		total.BranchesTook += e.BranchesTook
+	}
+	c.writeEntry(w, total, "total")
+}
+
+func (c *Coverage) writeEntry(w io.Writer, e CoverageEntry, name string) {
+	fmt.Fprintf(w, "%6.1f%% %11s %11s  %s\n", e.Percent(),
+		fmt.Sprintf("%d/%d", e.ExprsCovered, e.Exprs),
+		fmt.Sprintf("%d/%d", e.BranchesTook, e.Branches), name)
+}
+
+// WriteListing writes the source to w, each line after the number of times
+// the first expression starting on it was evaluated, or "#####" if none of
+// the expressions starting on it was. Under a line that has some of them
+// evaluated, a line marks the others with "^", and an if that never took
+// its then branch with "t", or its else branch with "e".
+func (c *Coverage) WriteListing(w io.Writer) {
+	m := c.m
+	type mark struct {
+		col  int
+		char byte
+	}
+	// By line: the count of its first expression, the offset of that
+	// expression, and how many of its expressions were evaluated.
+	counts := map[int]int{}
+	firsts := map[int]int{}
+	evaluated := map[int]int{}
+	marks := map[int][]mark{}
+	for _, f := range c.forms {
+		for _, x := range f.exprs {
+			off := m.Positions[x]
+			line := m.SourceLine(off)
+			col := off + 1
+			if line > 1 {
+				col -= m.newlines[line-2] + 1
+			}
+			if first, ok := firsts[line]; !ok || off < first {
+				counts[line], firsts[line] = c.hits[x], off
+			}
+			b, isIf := c.branches[x]
+			switch {
+			case c.hits[x] == 0:
+				marks[line] = append(marks[line], mark{col, '^'})
+				continue
+			case isIf && b[0] == 0:
+				marks[line] = append(marks[line], mark{col, 't'})
+			case isIf && b[1] == 0:
+				marks[line] = append(marks[line], mark{col, 'e'})
+			}
+			evaluated[line]++
+		}
+	}
+	lines := bytes.SplitAfter(m.Source, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	for i, text := range lines {
+		line := i + 1
+		text := strings.TrimRight(string(text), "\n")
+		count := ""
+		if _, ok := firsts[line]; ok {
+			count = fmt.Sprint(counts[line])
+			if evaluated[line] == 0 {
+				count = "#####"
+			}
+		}
+		fmt.Fprintf(w, "%9s | %s\n", count, text)
+		if evaluated[line] > 0 && len(marks[line]) > 0 {
+			under := bytes.Repeat([]byte(" "), len(text))
+			for _, mk := range marks[line] {
+				if mk.col <= len(under) {
+					under[mk.col-1] = mk.char
+				}
+			}
+			fmt.Fprintf(w, "%9s | %s\n", "", strings.TrimRight(string(under), " "))
+		}
+	}
+}
+
+// writeCoverage writes the coverage listing of m to the file name.
+func writeCoverage(m *Machine, name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	m.Coverage().WriteListing(f)
+	return f.Close()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCoverage(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		entries []CoverageEntry
+		listing string
+	}{
+		{
+			name: "branches",
+			src:  "define (f x)\n   if atom x x\n      (g x)\ndefine (g x) if = x nil 0 1\n(f 'a)\n(f '(b))\n",
+			entries: []CoverageEntry{
+				{"f", 1, 3, 3, 2, 2},
+				{"g", 4, 2, 2, 2, 1},
+				{"", 0, 4, 4, 0, 0},
+			},
+			listing: "" +
+				"          | define (f x)\n" +
+				"        2 |    if atom x x\n" +
+				"        1 |       (g x)\n" +
+				"        1 | define (g x) if = x nil 0 1\n" +
+				"          |              t\n" +
+				"        1 | (f 'a)\n" +
+				"        1 | (f '(b))\n",
+		},
+		{
+			name: "uncovered",
+			src:  "define (h x) cons x x\ndefine (k x) if atom x (car '(a)) (cons x x)\n(k 'a)\n",
+			entries: []CoverageEntry{
+				{"h", 1, 1, 0, 0, 0},
+				{"k", 2, 7, 5, 2, 1},
+				{"", 0, 2, 2, 0, 0},
+			},
+			listing: "" +
+				"    ##### | define (h x) cons x x\n" +
+				"        1 | define (k x) if atom x (car '(a)) (cons x x)\n" +
+				"          |              e                    ^^\n" +
+				"        1 | (k 'a)\n",
+		},
+		{
+			name:    "no code",
+			src:     "define x 5\ncar '(a)\n",
+			entries: []CoverageEntry{{"", 0, 2, 2, 0, 0}},
+			listing: "" +
+				"          | define x 5\n" +
+				"        1 | car '(a)\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMachine(strings.NewReader(tt.src), io.Discard)
+			c := m.Coverage()
+			if err := m.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Entries(); !reflect.DeepEqual(got, tt.entries) {
+				t.Errorf("Entries() = %+v, want %+v", got, tt.entries)
+			}
+			var listing bytes.Buffer
+			c.WriteListing(&listing)
+			if listing.String() != tt.listing {
+				t.Errorf("listing\n%s\nwant\n%s", listing.String(), tt.listing)
+			}
+		})
+	}
+}
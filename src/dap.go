@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// --- Debug Adapter ---
+
+// dapServer serves the Debug Adapter Protocol for one run of a program: the
+// client launches a file, sets breakpoints on its lines or functions, and
+// inspects the stack and bindings whenever the debugger stops. The machine
+// runs on a goroutine of its own; while it runs, changes to it are queued
+// and made by dapHook on that goroutine.
+type dapServer struct {
+	r   *bufio.Reader
+	w   io.Writer
+	wmu sync.Mutex // guards seq and w
+	seq int
+
+	m       *Machine
+	d       *Debugger
+	program string
+	out     *dapOutput
+	errOut  *dapOutput
+
+	mu          sync.Mutex // guards the fields below, and queue
+	state       int
+	launched    bool
+	configured  bool
+	stopOnEntry bool
+	queue       []func()
+	queued      atomic.Bool
+
+	entry   bool // the next stop is the one on entry
+	pausing bool // the next stop is for a pause request
+	frames  []int
+	resume  chan int
+}
+
+// The states of the run of a dapServer.
+const (
+	dapIdle = iota
+	dapRunning
+	dapStopped
+	dapDone
+)
+
+// dapMessage is a request, response or event.
+type dapMessage struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command,omitempty"`
+	Arguments  json.RawMessage `json:"arguments,omitempty"`
+	RequestSeq int             `json:"request_seq,omitempty"`
+	Success    *bool           `json:"success,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	Body       any             `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type dapBreakpoint struct {
+	Verified bool `json:"verified"`
+	Line     int  `json:"line,omitempty"`
+}
+
+type dapFrame struct {
+	ID     int        `json:"id"`
+	Name   string     `json:"name"`
+	Source *dapSource `json:"source,omitempty"`
+	Line   int        `json:"line"`
+	Column int        `json:"column"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// dapValueWidth is the number of characters a value is cut to.
+const dapValueWidth = 200
+
+// dapMain serves the Debug Adapter Protocol on standard input and output.
+func dapMain(args []string) int {
+	s := &dapServer{r: bufio.NewReader(os.Stdin), w: os.Stdout, resume: make(chan int)}
+	if err := s.serve(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitInternal
+	}
+	return ExitSuccess
+}
+
+func (s *dapServer) read() (*dapMessage, error) {
+	var msg dapMessage
+	if err := readMessage(s.r, &msg); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("dap: %v", err)
+	}
+	return &msg, nil
+}
+
+func (s *dapServer) send(msg *dapMessage) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	msg.Seq = s.seq
+	writeMessage(s.w, msg)
+}
+
+func (s *dapServer) event(event string, body any) {
+	s.send(&dapMessage{Type: "event", Event: event, Body: body})
+}
+
+func (s *dapServer) respond(req *dapMessage, body any) {
+	ok := true
+	s.send(&dapMessage{Type: "response", Command: req.Command, RequestSeq: req.Seq, Success: &ok, Body: body})
+}
+
+func (s *dapServer) fail(req *dapMessage, message string) {
+	ok := false
+	s.send(&dapMessage{Type: "response", Command: req.Command, RequestSeq: req.Seq, Success: &ok, Message: message})
+}
+
+// serve handles requests until the client disconnects or the input ends.
+func (s *dapServer) serve() error {
+	for {
+		req, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if !s.handle(req) {
+			return nil
+		}
+	}
+}
+
+// handle answers req, and reports whether to go on serving.
+func (s *dapServer) handle(req *dapMessage) bool {
+	switch req.Command {
+	case "initialize":
+		s.respond(req, map[string]bool{
+			"supportsConfigurationDoneRequest": true,
+			"supportsFunctionBreakpoints":      true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		})
+		s.event("initialized", nil)
+	case "launch":
+		s.launch(req)
+	case "setBreakpoints":
+		s.setBreakpoints(req)
+	case "setFunctionBreakpoints":
+		s.setFunctionBreakpoints(req)
+	case "setExceptionBreakpoints":
+		s.respond(req, map[string]any{"breakpoints": []dapBreakpoint{}})
+	case "configurationDone":
+		s.mu.Lock()
+		s.configured = true
+		s.mu.Unlock()
+		s.respond(req, nil)
+		s.start()
+	case "threads":
+		s.respond(req, map[string]any{"threads": []map[string]any{{"id": 1, "name": "lisp"}}})
+	case "stackTrace":
+		s.stackTrace(req)
+	case "scopes":
+		s.scopes(req)
+	case "variables":
+		s.variables(req)
+	case "evaluate":
+		s.evaluate(req)
+	case "continue":
+		s.respond(req, map[string]bool{"allThreadsContinued": true})
+		s.proceed(DebugContinue)
+	case "next":
+		s.respond(req, nil)
+		s.proceed(DebugStepOver)
+	case "stepIn":
+		s.respond(req, nil)
+		s.proceed(DebugStepInto)
+	case "stepOut":
+		s.respond(req, nil)
+		s.proceed(DebugStepOut)
+	case "pause":
+		s.onMachine(func() {
+			s.d.mode = DebugStepInto
+			s.pausing = true
+		})
+		s.respond(req, nil)
+	case "terminate":
+		s.stop()
+		s.respond(req, nil)
+	case "disconnect":
+		s.stop()
+		s.respond(req, nil)
+		return false
+	default:
+		s.fail(req, fmt.Sprintf("%s is not supported", req.Command))
+	}
+	return true
+}
+
+// machine returns the machine the program runs on, making it on first use.
+func (s *dapServer) machine() *Machine {
+	if s.m == nil {
+		s.out = &dapOutput{s: s, category: "stdout"}
+		s.errOut = &dapOutput{s: s, category: "stderr"}
+		s.m = NewMachine(strings.NewReader(""), s.out)
+		s.m.ErrWriter = s.errOut
+		s.d = s.m.Debugger()
+		s.d.OnStop = s.onStop
+		s.m.AddHook(&dapHook{s: s})
+	}
+	return s.m
+}
+
+func (s *dapServer) launch(req *dapMessage) {
+	var args struct {
+		Program     string `json:"program"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil || args.Program == "" {
+		s.fail(req, "launch needs a program")
+		return
+	}
+	src, err := os.ReadFile(args.Program)
+	if err != nil {
+		s.fail(req, err.Error())
+		return
+	}
+	if err := CheckSyntax(src); err != nil {
+		s.fail(req, fmt.Sprintf("%s:%v", args.Program, err))
+		return
+	}
+	if len(src) > 0 && src[len(src)-1] != '\n' {
+		src = append(src, '\n')
+	}
+	m := s.machine()
+	m.Reader = bufio.NewReader(bytes.NewReader(src))
+	s.program, _ = filepath.Abs(args.Program)
+	s.mu.Lock()
+	s.launched = true
+	s.stopOnEntry = args.StopOnEntry
+	s.mu.Unlock()
+	s.respond(req, nil)
+	s.start()
+}
+
+// start runs the program once it is launched and configured.
+func (s *dapServer) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.launched || !s.configured || s.state != dapIdle {
+		return
+	}
+	if s.stopOnEntry {
+		s.d.mode = DebugStepInto
+		s.entry = true
+	}
+	s.state = dapRunning
+	go s.run()
+}
+
+func (s *dapServer) run() {
+	status := exitStatus([]inputFile{{s.program, 1}}, s.m.Run)
+	s.out.flush()
+	s.errOut.flush()
+	s.mu.Lock()
+	s.state = dapDone
+	s.mu.Unlock()
+	s.event("exited", map[string]int{"exitCode": status})
+	s.event("terminated", nil)
+}
+
+// onMachine calls f when the machine is not running, at once if it is
+// stopped or has not started yet, or else on its goroutine at the next call
+// of Eval.
+func (s *dapServer) onMachine(f func()) {
+	s.machine()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != dapRunning {
+		f()
+		return
+	}
+	s.queue = append(s.queue, f)
+	s.queued.Store(true)
+}
+
+// dapHook makes the changes a dapServer queued while the machine ran.
+type dapHook struct {
+	BaseHook
+	s *dapServer
+}
+
+func (h *dapHook) Enter(e int) {
+	s := h.s
+	if !s.queued.Load() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.queue {
+		f()
+	}
+	s.queue = nil
+	s.queued.Store(false)
+}
+
+// onStop tells the client that the debugger stopped, and waits for it to
+// say how to go on.
+func (s *dapServer) onStop(st *Stop) int {
+	reason := "step"
+	switch {
+	case s.entry:
+		reason = "entry"
+	case s.pausing:
+		reason = "pause"
+	case st.Reason == "line":
+		reason = "breakpoint"
+	case st.Reason == "breakpoint":
+		reason = "function breakpoint"
+	}
+	s.entry, s.pausing = false, false
+	s.out.flush()
+	s.errOut.flush()
+	s.mu.Lock()
+	s.state = dapStopped
+	s.mu.Unlock()
+	s.event("stopped", map[string]any{"reason": reason, "threadId": 1, "allThreadsStopped": true})
+	return <-s.resume
+}
+
+// proceed goes on with the run in mode, if the debugger stopped it.
+func (s *dapServer) proceed(mode int) {
+	s.mu.Lock()
+	if s.state != dapStopped {
+		s.mu.Unlock()
+		return
+	}
+	s.state = dapRunning
+	s.mu.Unlock()
+	s.resume <- mode
+}
+
+// stop ends the run: it is interrupted at the next call of Eval, without
+// stopping on the way.
+func (s *dapServer) stop() {
+	if s.m == nil {
+		return
+	}
+	s.onMachine(func() {
+		s.d.Breaks, s.d.Lines, s.d.At = nil, nil, 0
+	})
+	s.m.Interrupt()
+	s.proceed(DebugContinue)
+}
+
+// stopped reports whether the debugger stopped the run, so that the machine
+// can be inspected.
+func (s *dapServer) stopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == dapStopped
+}
+
+func (s *dapServer) setBreakpoints(req *dapMessage) {
+	var args struct {
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	json.Unmarshal(req.Arguments, &args)
+	lines := map[int]bool{}
+	bps := []dapBreakpoint{}
+	for _, b := range args.Breakpoints {
+		lines[b.Line] = true
+		bps = append(bps, dapBreakpoint{true, b.Line})
+	}
+	s.onMachine(func() { s.d.Lines = lines })
+	s.respond(req, map[string]any{"breakpoints": bps})
+}
+
+func (s *dapServer) setFunctionBreakpoints(req *dapMessage) {
+	var args struct {
+		Breakpoints []struct {
+			Name string `json:"name"`
+		} `json:"breakpoints"`
+	}
+	json.Unmarshal(req.Arguments, &args)
+	names := map[string]bool{}
+	bps := []dapBreakpoint{}
+	for _, b := range args.Breakpoints {
+		names[b.Name] = true
+		bps = append(bps, dapBreakpoint{Verified: true})
+	}
+	s.onMachine(func() { s.d.Breaks = names })
+	s.respond(req, map[string]any{"breakpoints": bps})
+}
+
+// exprPos returns the position of the innermost of exprs that was read from
+// the program, or 0, 0 if there is none.
+func (s *dapServer) exprPos(exprs []int) (line, col int) {
+	m := s.m
+	for i := len(exprs) - 1; i >= 0; i-- {
+		if off, ok := m.Positions[exprs[i]]; ok {
+			return sourcePos(m.Source, off)
+		}
+	}
+	return 0, 0
+}
+
+// stackTrace lists the applications in progress, innermost first, each at
+// the expression it is evaluating, and then the top-level form.
+func (s *dapServer) stackTrace(req *dapMessage) {
+	if !s.stopped() {
+		s.respond(req, map[string]any{"stackFrames": []dapFrame{}, "totalFrames": 0})
+		return
+	}
+	m := s.m
+	exprs := s.d.Exprs()
+	source := &dapSource{filepath.Base(s.program), s.program}
+	frames := []dapFrame{}
+	s.frames = s.frames[:0]
+	for i := len(m.Stack) - 1; i >= -1; i-- {
+		name := "<top>"
+		if i >= 0 {
+			name = shorten(m.FrameString(m.Stack[i]), dapValueWidth)
+		}
+		f := dapFrame{ID: len(frames) + 1, Name: name}
+		if f.Line, f.Column = s.exprPos(exprs); f.Line > 0 {
+			f.Source = source
+		}
+		frames = append(frames, f)
+		s.frames = append(s.frames, i)
+		if i >= 0 {
+			// The caller is at the call of this application.
+			exprs = exprs[:min(max(m.Stack[i].Depth, 0), len(exprs))]
+		}
+	}
+	s.respond(req, map[string]any{"stackFrames": frames, "totalFrames": len(frames)})
+}
+
+// The variablesReference of the bindings, and of the arguments of the
+// application at index i of Stack.
+const (
+	dapBindings = 1
+	dapArgs     = 2
+)
+
+func (s *dapServer) scopes(req *dapMessage) {
+	var args struct {
+		FrameID int `json:"frameId"`
+	}
+	json.Unmarshal(req.Arguments, &args)
+	scopes := []map[string]any{}
+	if i := args.FrameID - 1; i >= 0 && i < len(s.frames) && s.frames[i] >= 0 {
+		scopes = append(scopes, map[string]any{"name": "Arguments", "variablesReference": dapArgs + s.frames[i], "expensive": false})
+	}
+	scopes = append(scopes, map[string]any{"name": "Bindings", "variablesReference": dapBindings, "expensive": false})
+	s.respond(req, map[string]any{"scopes": scopes})
+}
+
+func (s *dapServer) variables(req *dapMessage) {
+	var args struct {
+		Ref int `json:"variablesReference"`
+	}
+	json.Unmarshal(req.Arguments, &args)
+	vars := []dapVariable{}
+	if !s.stopped() {
+		s.respond(req, map[string]any{"variables": vars})
+		return
+	}
+	m := s.m
+	switch {
+	case args.Ref == dapBindings:
+		for _, b := range s.d.Bindings() {
+			vars = append(vars, dapVariable{m.NameString(b.Sym), s.valueStack(b.Values), 0})
+		}
+	case args.Ref >= dapArgs && args.Ref-dapArgs < len(m.Stack):
+		f := m.Stack[args.Ref-dapArgs]
+		params := m.Car(m.Cdr(f.Func))
+		for a := f.Args; !m.IsAtom(a); a = m.Cdr(a) {
+			name := "?"
+			if !m.IsAtom(params) {
+				name = m.SexpString(m.Car(params))
+				params = m.Cdr(params)
+			}
+			vars = append(vars, dapVariable{name, shorten(m.SexpString(m.Car(a)), dapValueWidth), 0})
+		}
+	}
+	s.respond(req, map[string]any{"variables": vars})
+}
+
+// valueStack returns the values of a symbol, innermost first, as the
+// debugger prompt shows them.
+func (s *dapServer) valueStack(values []int) string {
+	var parts []string
+	for _, v := range values {
+		parts = append(parts, shorten(s.m.SexpString(v), dapValueWidth))
+	}
+	return strings.Join(parts, " | ")
+}
+
+// evaluate shows the value stack of a symbol. Evaluating expressions would
+// change the machine, so it is not offered.
+func (s *dapServer) evaluate(req *dapMessage) {
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	json.Unmarshal(req.Arguments, &args)
+	if !s.stopped() {
+		s.fail(req, "the program is running")
+		return
+	}
+	x, ok := s.m.LookupAtom(strings.TrimSpace(args.Expression))
+	if !ok {
+		s.fail(req, "only the value of an atom the program uses can be shown")
+		return
+	}
+	s.respond(req, map[string]any{"result": s.valueStack(s.m.ValueStack(x)), "variablesReference": 0})
+}
+
+// dapOutput sends what the machine writes to the client as output events
+// of a category, a line at a time.
+type dapOutput struct {
+	s        *dapServer
+	category string
+	buf      []byte
+}
+
+func (o *dapOutput) Write(p []byte) (int, error) {
+	o.buf = append(o.buf, p...)
+	if i := bytes.LastIndexByte(o.buf, '\n'); i >= 0 {
+		o.send(o.buf[:i+1])
+		o.buf = append(o.buf[:0], o.buf[i+1:]...)
+	}
+	return len(p), nil
+}
+
+func (o *dapOutput) flush() {
+	if len(o.buf) > 0 {
+		o.send(o.buf)
+		o.buf = o.buf[:0]
+	}
+}
+
+func (o *dapOutput) send(p []byte) {
+	o.s.event("output", map[string]string{"category": o.category, "output": string(p)})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dapClient talks to a dapServer over a pipe.
+type dapClient struct {
+	t       *testing.T
+	w       io.Writer
+	msgs    chan *dapMessage
+	seq     int
+	pending []*dapMessage // events read while waiting for a response
+}
+
+func newDAPClient(t *testing.T) (*dapClient, chan error) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	s := &dapServer{r: bufio.NewReader(sr), w: sw, resume: make(chan int)}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.serve()
+		sw.Close()
+	}()
+	c := &dapClient{t: t, w: cw, msgs: make(chan *dapMessage)}
+	go func() {
+		r := bufio.NewReader(cr)
+		for {
+			var msg dapMessage
+			if err := readMessage(r, &msg); err != nil {
+				close(c.msgs)
+				return
+			}
+			c.msgs <- &msg
+		}
+	}()
+	t.Cleanup(func() { cw.Close() })
+	return c, done
+}
+
+func (c *dapClient) next() *dapMessage {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			c.t.Fatal("the server closed the connection")
+		}
+		return msg
+	case <-time.After(10 * time.Second):
+		c.t.Fatal("timed out waiting for the server")
+	}
+	return nil
+}
+
+// request sends a request and returns the body of its response, decoded
+// into body.
+func (c *dapClient) request(command string, args any, body any) {
+	c.t.Helper()
+	c.seq++
+	raw, _ := json.Marshal(args)
+	writeMessage(c.w, &dapMessage{Seq: c.seq, Type: "request", Command: command, Arguments: raw})
+	for {
+		msg := c.next()
+		if msg.Type == "event" {
+			c.pending = append(c.pending, msg)
+			continue
+		}
+		if msg.RequestSeq != c.seq || msg.Command != command {
+			c.t.Fatalf("%s: got a response to %s", command, msg.Command)
+		}
+		if msg.Success == nil || !*msg.Success {
+			c.t.Fatalf("%s failed: %s", command, msg.Message)
+		}
+		decodeBody(c.t, msg, body)
+		return
+	}
+}
+
+// event waits for the event name and decodes its body into body. It returns
+// the output sent before it.
+func (c *dapClient) event(name string, body any) (output string) {
+	c.t.Helper()
+	for {
+		var msg *dapMessage
+		if len(c.pending) > 0 {
+			msg, c.pending = c.pending[0], c.pending[1:]
+		} else {
+			msg = c.next()
+		}
+		switch {
+		case msg.Type != "event":
+			c.t.Fatalf("waiting for %s: got a response to %s", name, msg.Command)
+		case msg.Event == name:
+			decodeBody(c.t, msg, body)
+			return output
+		case msg.Event == "output":
+			var out struct{ Output string }
+			decodeBody(c.t, msg, &out)
+			output += out.Output
+		}
+	}
+}
+
+func decodeBody(t *testing.T, msg *dapMessage, body any) {
+	t.Helper()
+	if body == nil {
+		return
+	}
+	raw, _ := json.Marshal(msg.Body)
+	if err := json.Unmarshal(raw, body); err != nil {
+		t.Fatalf("%s%s: %v", msg.Command, msg.Event, err)
+	}
+}
+
+func TestDAP(t *testing.T) {
+	program := filepath.Join(t.TempDir(), "t.l")
+	src := "define (f x)\n   cons x nil\n(f 'a)\n"
+	if err := os.WriteFile(program, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c, done := newDAPClient(t)
+
+	var caps map[string]bool
+	c.request("initialize", map[string]string{"adapterID": "lisp"}, &caps)
+	if !caps["supportsConfigurationDoneRequest"] {
+		t.Errorf("initialize: capabilities %v", caps)
+	}
+	c.event("initialized", nil)
+
+	var bps struct{ Breakpoints []dapBreakpoint }
+	c.request("setBreakpoints", map[string]any{
+		"source":      dapSource{"t.l", program},
+		"breakpoints": []map[string]int{{"line": 2}},
+	}, &bps)
+	if want := []dapBreakpoint{{true, 2}}; !reflect.DeepEqual(bps.Breakpoints, want) {
+		t.Errorf("setBreakpoints: %v, want %v", bps.Breakpoints, want)
+	}
+	c.request("launch", map[string]any{"program": program}, nil)
+	c.request("configurationDone", nil, nil)
+
+	var stopped struct{ Reason string }
+	c.event("stopped", &stopped)
+	if stopped.Reason != "breakpoint" {
+		t.Errorf("stopped for %q, want breakpoint", stopped.Reason)
+	}
+
+	var trace struct{ StackFrames []dapFrame }
+	c.request("stackTrace", map[string]int{"threadId": 1}, &trace)
+	var frames []string
+	for _, f := range trace.StackFrames {
+		frames = append(frames, f.Name)
+		if f.Source == nil || f.Source.Path != program {
+			t.Errorf("frame %s: source %v, want %s", f.Name, f.Source, program)
+		}
+	}
+	if want := []string{"(f a)", "<top>"}; !reflect.DeepEqual(frames, want) {
+		t.Fatalf("stackTrace: %q, want %q", frames, want)
+	}
+	if f := trace.StackFrames[0]; f.Line != 2 {
+		t.Errorf("stackTrace: frame (f a) on line %d, want 2", f.Line)
+	}
+	if f := trace.StackFrames[1]; f.Line != 3 {
+		t.Errorf("stackTrace: frame <top> on line %d, want 3", f.Line)
+	}
+
+	var scopes struct {
+		Scopes []struct {
+			Name               string
+			VariablesReference int
+		}
+	}
+	c.request("scopes", map[string]int{"frameId": trace.StackFrames[0].ID}, &scopes)
+	refs := map[string]int{}
+	for _, sc := range scopes.Scopes {
+		refs[sc.Name] = sc.VariablesReference
+	}
+	if refs["Arguments"] == 0 || refs["Bindings"] == 0 {
+		t.Fatalf("scopes: %v, want Arguments and Bindings", scopes.Scopes)
+	}
+	var vars struct{ Variables []dapVariable }
+	c.request("variables", map[string]int{"variablesReference": refs["Arguments"]}, &vars)
+	if want := []dapVariable{{"x", "a", 0}}; !reflect.DeepEqual(vars.Variables, want) {
+		t.Errorf("variables of Arguments: %v, want %v", vars.Variables, want)
+	}
+	c.request("variables", map[string]int{"variablesReference": refs["Bindings"]}, &vars)
+	want := []dapVariable{{"x", "a | x", 0}, {"f", "(lambda (x) (cons x nil))", 0}}
+	if !reflect.DeepEqual(vars.Variables, want) {
+		t.Errorf("variables of Bindings: %v, want %v", vars.Variables, want)
+	}
+
+	c.request("continue", map[string]int{"threadId": 1}, nil)
+	var exited struct{ ExitCode int }
+	output := c.event("exited", &exited)
+	if exited.ExitCode != ExitSuccess {
+		t.Errorf("exit code %d, want %d", exited.ExitCode, ExitSuccess)
+	}
+	if want := "value       (a)\n"; !strings.Contains(output, want) {
+		t.Errorf("output %q does not contain %q", output, want)
+	}
+	c.event("terminated", nil)
+
+	c.request("disconnect", nil, nil)
+	if err := <-done; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+}
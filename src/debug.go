@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// --- Debugger ---
+
+// How evaluation goes on after the debugger stopped.
+const (
+	DebugContinue = iota // until the next breakpoint
+	DebugStepInto        // stop at the next call of Eval
+	DebugStepOver        // stop after the current expression
+	DebugStepOut         // stop after the expression that contains it
+)
+
+// Stop describes where the debugger stopped.
+type Stop struct {
+	Reason string // "breakpoint", "line", "step" or "steps"
+	Expr   int    // the expression being evaluated
+	Frame  *Frame // the application entered, for a breakpoint
+}
+
+// Debugger stops evaluation on entry to chosen functions or source lines,
+// after a number of eval steps, or after a step, and calls OnStop, which
+// inspects the machine and returns how to go on. OnStop runs on the
+// goroutine of the machine, which waits for it to return.
+type Debugger struct {
+	BaseHook
+	m      *Machine
+	Breaks map[string]bool // names of functions to stop on entry to
+	Lines  map[int]bool    // lines of Source to stop on, with Positions set
+	At     int             // stop when TimeEval reaches At, if not 0
+	OnStop func(s *Stop) int
+
+	mode  int
+	last  int // the last step command of the prompt
+	depth int // the EvalDepth a step over or out is relative to
+	exprs []int
+}
+
+// Debugger returns the debugger of m. Unless OnStop is changed, it prompts
+// for commands on the terminal. From then on the reader notes the Positions
+// of what it reads, for line breakpoints.
+func (m *Machine) Debugger() *Debugger {
+	if m.debugger == nil {
+		if m.Positions == nil {
+			m.Positions = map[int]int{}
+		}
+		d := &Debugger{m: m, Breaks: map[string]bool{}, Lines: map[int]bool{}, last: DebugStepInto}
+		d.OnStop = d.prompt
+		m.debugger = d
+		m.AddHook(d)
+	}
+	return m.debugger
+}
+
+// Break starts or stops breaking on entry to the function named by the
+// symbol name.
+func (m *Machine) Break(name int, on bool) {
+	d := m.Debugger()
+	if on {
+		d.Breaks[m.NameString(name)] = true
+	} else {
+		delete(d.Breaks, m.NameString(name))
+	}
+}
+
+// Expr returns the expression being evaluated.
+func (d *Debugger) Expr() int {
+	if len(d.exprs) == 0 {
+		return Nil
+	}
+	return d.exprs[len(d.exprs)-1]
+}
+
+// Exprs returns the expressions being evaluated, innermost last. The call
+// of the application in a Frame is the one at index Depth-1.
+func (d *Debugger) Exprs() []int {
+	return d.exprs
+}
+
+// Frames returns the applications in progress, innermost last.
+func (d *Debugger) Frames() []Frame {
+	return d.m.Stack
+}
+
+// Binding is a symbol with the stack of its values, innermost first.
+type Binding struct {
+	Sym    int
+	Values []int
+}
+
+// ValueStack returns the values of the symbol x, innermost first: the value
+// it has now, then those that Bind, try and eval saved.
+func (m *Machine) ValueStack(x int) []int {
+	var values []int
+	for v := m.Value(x); !m.IsAtom(v); v = m.Cdr(v) {
+		values = append(values, m.Car(v))
+	}
+	return values
+}
+
+// Bindings returns the symbols that are bound, by a lambda, try or eval,
+// or by define, with their value stacks. A lambda binds its arguments after
+// the debugger stops on entry to it.
+func (d *Debugger) Bindings() []Binding {
+	m := d.m
+	var bindings []Binding
+	for o := m.ObjectList; o != Nil; o = m.Cdr(o) {
+		x := m.Car(o)
+		values := m.ValueStack(x)
+		if x != m.SymNil && (len(values) > 1 || len(values) == 1 && values[0] != x) {
+			bindings = append(bindings, Binding{x, values})
+		}
+	}
+	return bindings
+}
+
+func (d *Debugger) stop(s *Stop) {
+	d.mode = d.OnStop(s)
+	d.depth = d.m.EvalDepth
+}
+
+func (d *Debugger) Enter(e int) {
+	m := d.m
+	if m.EvalDepth == 1 {
+		// A new top-level expression: drop what a failure of the last
+		// one left behind.
+		d.exprs = d.exprs[:0]
+	}
+	d.exprs = append(d.exprs, e)
+	switch {
+	case d.At > 0 && m.TimeEval >= d.At:
+		d.At = 0
+		d.stop(&Stop{Reason: "steps", Expr: e})
+	case len(d.Lines) > 0 && d.atLine(e):
+		d.stop(&Stop{Reason: "line", Expr: e})
+	case d.mode == DebugStepInto,
+		d.mode == DebugStepOver && m.EvalDepth <= d.depth,
+		d.mode == DebugStepOut && m.EvalDepth < d.depth:
+		d.stop(&Stop{Reason: "step", Expr: e})
+	}
+}
+
+// atLine reports whether e, the expression just entered, starts on one of
+// Lines and is the first expression on its line that the innermost
+// application evaluates, so that a line stops once for each time it is
+// reached.
+func (d *Debugger) atLine(e int) bool {
+	m := d.m
+	line, ok := m.ExprLine(e)
+	if !ok || !d.Lines[line] {
+		return false
+	}
+	lo := 0
+	if len(m.Stack) > 0 {
+		lo = m.Stack[len(m.Stack)-1].Depth
+	}
+	for i := len(d.exprs) - 2; i >= lo; i-- {
+		if l, ok := m.ExprLine(d.exprs[i]); ok {
+			return l != line
+		}
+	}
+	return true
+}
+
+func (d *Debugger) Leave(e, v int) {
+	if len(d.exprs) > 0 {
+		d.exprs = d.exprs[:len(d.exprs)-1]
+	}
+}
+
+func (d *Debugger) Apply(f, name, args int) {
+	m := d.m
+	if m.IsAtom(f) || m.Car(f) != m.SymLambda {
+		return
+	}
+	if name != Nil && d.Breaks[m.NameString(name)] {
+		d.stop(&Stop{Reason: "breakpoint", Expr: d.Expr(), Frame: &m.Stack[len(m.Stack)-1]})
+	}
+}
+
+// --- Debugger Prompt ---
+
+const debugHelp = `s, step       evaluate the next subexpression and stop
+n, next       stop after this expression
+o, out        stop after the expression that contains this one
+c, continue   go on to the next breakpoint
+e, expr       show the expression being evaluated
+a, args       show the arguments of the innermost application
+bt            show the applications in progress
+b, bindings   show the bound symbols with their value stacks
+p sym         show the value stack of sym
+break f       stop on entry to f, or at line f if it is a number;
+              unbreak f stops doing so
+at n          stop when the number of eval calls reaches n
+heap [n]      report on the heap, with the n largest structures
+An empty line repeats the last step command.
+`
+
+// prompt shows where the debugger stopped on m.ErrWriter and reads commands
+// from the terminal until one goes on with the evaluation. At the end of the
+// input, or without a terminal, it clears the breakpoints and continues.
+func (d *Debugger) prompt(s *Stop) int {
+	m := d.m
+	w := m.ErrWriter
+	fmt.Fprintf(w, "%s at eval %d, depth %d\n", s.Reason, m.TimeEval, m.EvalDepth)
+	if s.Frame != nil {
+		fmt.Fprintf(w, "  %s\n", m.FrameString(*s.Frame))
+	} else {
+		fmt.Fprintf(w, "  %s\n", m.SexpString(s.Expr))
+	}
+	editor := m.debugEditor()
+	if editor == nil {
+		return DebugContinue
+	}
+	for {
+		line, err := editor.ReadLine("debug> ")
+		if err == errInterrupt {
+			continue
+		}
+		if err != nil {
+			d.Breaks = map[string]bool{}
+			d.At = 0
+			return DebugContinue
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+		arg = strings.TrimSpace(arg)
+		switch cmd {
+		case "":
+			return d.last
+		case "s", "step":
+			d.last = DebugStepInto
+			return d.last
+		case "n", "next":
+			d.last = DebugStepOver
+			return d.last
+		case "o", "out":
+			d.last = DebugStepOut
+			return d.last
+		case "c", "continue":
+			return DebugContinue
+		case "e", "expr":
+			fmt.Fprintf(w, "%s\n", m.SexpString(d.Expr()))
+		case "a", "args":
+			if len(m.Stack) == 0 {
+				fmt.Fprintf(w, "no application in progress\n")
+				break
+			}
+			f := m.Stack[len(m.Stack)-1]
+			vars := m.Car(m.Cdr(f.Func))
+			for args := f.Args; !m.IsAtom(args); args = m.Cdr(args) {
+				name := "?"
+				if !m.IsAtom(vars) {
+					name = m.SexpString(m.Car(vars))
+					vars = m.Cdr(vars)
+				}
+				fmt.Fprintf(w, "%s = %s\n", name, m.SexpString(m.Car(args)))
+			}
+		case "bt":
+			for i := len(m.Stack) - 1; i >= 0; i-- {
+				fmt.Fprintf(w, "#%d %s\n", len(m.Stack)-1-i, m.FrameString(m.Stack[i]))
+			}
+		case "b", "bindings":
+			for _, b := range d.Bindings() {
+				d.printStack(w, b.Sym, b.Values)
+			}
+		case "p":
+			if x, ok := m.LookupAtom(arg); ok {
+				d.printStack(w, x, m.ValueStack(x))
+			} else {
+				fmt.Fprintf(w, "%s is not an atom the program uses\n", arg)
+			}
+		case "break":
+			if n, err := strconv.Atoi(arg); err == nil {
+				d.Lines[n] = true
+			} else if arg != "" {
+				d.Breaks[arg] = true
+			}
+		case "unbreak":
+			if n, err := strconv.Atoi(arg); err == nil {
+				delete(d.Lines, n)
+			}
+			delete(d.Breaks, arg)
+		case "at":
+			if n, err := strconv.Atoi(arg); err == nil {
+				d.At = n
+			}
+		case "heap":
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				n = 10
+			}
+			m.HeapStats(n).Write(w, m, backtraceWidth)
+		case "h", "help":
+			fmt.Fprint(w, debugHelp)
+		default:
+			fmt.Fprintf(w, "unknown command %q; h for help\n", cmd)
+		}
+	}
+}
+
+func (d *Debugger) printStack(w io.Writer, x int, values []int) {
+	m := d.m
+	fmt.Fprintf(w, "%s =", m.NameString(x))
+	for i, v := range values {
+		if i > 0 {
+			fmt.Fprintf(w, " |")
+		}
+		fmt.Fprintf(w, " %s", m.SexpString(v))
+	}
+	fmt.Fprintln(w)
+}
+
+// debugEditor returns the line editor the debugger prompts with: the one of
+// the REPL, or else one on the terminal, or nil if there is none.
+func (m *Machine) debugEditor() *LineEditor {
+	if m.editor != nil {
+		return m.editor
+	}
+	in := os.Stdin
+	if !IsTerminal(in) {
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			return nil
+		}
+		in = tty
+	}
+	m.editor = NewLineEditor(in, m.ErrWriter)
+	return m.editor
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDebuggerPrompt(t *testing.T) {
+	src := "define (f x) cons x nil\n(f 3)\n(f 4)\n"
+	var errOut bytes.Buffer
+	m := NewMachine(strings.NewReader(src), io.Discard)
+	m.ErrWriter = &errOut
+	// The commands run out at the second stop, which clears the
+	// breakpoints: (f 4) runs without stopping.
+	m.editor = &LineEditor{out: io.Discard, r: bufio.NewReader(strings.NewReader("a\nbt\np x\nbogus\ns\ne\n"))}
+	m.Debugger().Breaks["f"] = true
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	want := "breakpoint at eval 3, depth 1\n" +
+		"  (f 3)\n" +
+		"x = 3\n" +
+		"#0 (f 3)\n" +
+		"x = x\n" + // bound after the stop on entry
+		"unknown command \"bogus\"; h for help\n" +
+		"step at eval 3, depth 2\n" +
+		"  (cons x nil)\n" +
+		"(cons x nil)\n"
+	if got := errOut.String(); got != want {
+		t.Errorf("debugger wrote\n%s\nwant\n%s", got, want)
+	}
+}
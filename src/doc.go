@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+)
+
+// --- Documentation Comments ---
+
+// beginForm starts collecting the comments of the next top-level form.
+func (m *Machine) beginForm() {
+	m.Comments = m.Comments[:0]
+	m.lastFormEnd = m.formEnd
+	m.formStart = -1
+}
+
+// wordRead notes that InWord returned the word at WordPos.
+func (m *Machine) wordRead() {
+	if m.formStart < 0 {
+		m.formStart = m.WordPos
+	}
+	m.formEnd = m.WordEnd
+}
+
+func (m *Machine) addComment(start, end int) {
+	c := Comment{Token: Token{Text: string(m.Source[start:end]), Off: start, End: end}}
+	m.Comments = append(m.Comments, c)
+}
+
+// formDoc returns the comment that documents the top-level form just read:
+// the comments right before it, up to a blank line or the end of the previous
+// form, or else a comment on the same line as its first word.
+func (m *Machine) formDoc() string {
+	var lines []string
+	next := m.formStart
+	for i := len(m.Comments) - 1; i >= 0; i-- {
+		c := m.Comments[i]
+		if c.End > m.formStart {
+			continue
+		}
+		if blankLineBetween(m.Source, c.End, next) || m.lastFormEnd > 0 && !newlineBetween(m.Source, m.lastFormEnd, c.Off) {
+			break
+		}
+		lines = append([]string{commentText(c.Text)}, lines...)
+		next = c.Off
+	}
+	if len(lines) == 0 {
+		for _, c := range m.Comments {
+			if c.Off > m.formStart && !newlineBetween(m.Source, m.formStart, c.Off) {
+				return commentText(c.Text)
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func newlineBetween(src []byte, from, to int) bool {
+	return strings.Contains(string(src[from:to]), "\n")
+}
+
+// commentText strips the brackets around a comment, however deeply nested,
+// and the white space around each of its lines.
+func commentText(text string) string {
+	for len(text) >= 2 && text[0] == '[' && matchingBracket(text) == len(text)-1 {
+		text = strings.TrimSpace(text[1 : len(text)-1])
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.Trim(strings.Join(lines, "\n"), "\n")
+}
+
+// matchingBracket returns the index of the "]" that closes the "[" at the
+// start of text, or -1.
+func matchingBracket(text string) int {
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// setDoc records the documentation of the symbol a top-level define has just
+// defined. A definition without a comment removes any earlier one.
+func (m *Machine) setDoc(name int) {
+	if m.docs == nil {
+		m.docs = make(map[int]string)
+	}
+	if doc := m.formDoc(); doc != "" {
+		m.docs[name] = doc
+	} else {
+		delete(m.docs, name)
+	}
+}
+
+// PrintDoc prints the documentation of the defined symbol name.
+func (m *Machine) PrintDoc(name int) {
+	doc, ok := m.docs[name]
+	if m.form != nil {
+		m.form.Doc = doc
+	}
+	if !ok {
+		doc = "(none)"
+	}
+	m.Out.Record("doc", name)
+	m.Out.Text("comment", doc)
+}
+
+// LookupAtom returns the atom called name if it has been interned.
+func (m *Machine) LookupAtom(name string) (int, bool) {
+	for i := m.ObjectList; !m.IsAtom(i); i = m.Cdr(i) {
+		if m.NameString(m.Car(i)) == name {
+			return m.Car(i), true
+		}
+	}
+	return Nil, false
+}
+
+// Doc returns the comment that documents the top-level definition of name.
+func (m *Machine) Doc(name string) (string, bool) {
+	a, ok := m.LookupAtom(name)
+	if !ok {
+		return "", false
+	}
+	doc, ok := m.docs[a]
+	return doc, ok
+}
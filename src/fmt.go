@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// --- Source Formatter ---
+
+// The formatter lays out each top-level form by the structure the reader
+// gives it: an atom with a reader arity takes that many arguments, exactly as
+// in readFrom. Only the white space between words changes; comments are kept
+// verbatim, so the formatted file reads as the same sequence of words.
+
+const (
+	fmtAtom   = iota
+	fmtClose  // a ")" where an expression was expected, read as ()
+	fmtList   // ( ... )
+	fmtPrefix // ' or " followed by one expression
+	fmtApp    // an atom with a reader arity followed by its arguments
+)
+
+type fmtNode struct {
+	kind  int
+	word  *Word // the atom, the prefix, the head of an application or "("
+	close *Word // the ")" of a list
+	sym   int
+	kids  []*fmtNode
+}
+
+func (n *fmtNode) first() *Word {
+	return n.word
+}
+
+func (n *fmtNode) last() *Word {
+	if n.kind == fmtList {
+		return n.close
+	}
+	if len(n.kids) > 0 {
+		return n.kids[len(n.kids)-1].last()
+	}
+	return n.word
+}
+
+func (n *fmtNode) words(out []*Word) []*Word {
+	out = append(out, n.word)
+	for _, k := range n.kids {
+		out = k.words(out)
+	}
+	if n.kind == fmtList {
+		out = append(out, n.close)
+	}
+	return out
+}
+
+type fmtParser struct {
+	m     *Machine
+	words []*Word
+	next  int
+	open  []*Word
+	head  bool // the next word starts a top-level form
+}
+
+func (p *fmtParser) parse(mexp bool) (*fmtNode, error) {
+	if p.next >= len(p.words) {
+		w := p.open[len(p.open)-1]
+		return nil, &SyntaxError{w.Line, w.Col, fmt.Sprintf("unexpected end of file in %q", w.Text)}
+	}
+	w := p.words[p.next]
+	p.next++
+	head := p.head
+	p.head = false
+	m := p.m
+	a := m.tokenToExpr(m.MkString(w.Text))
+	n := &fmtNode{kind: fmtAtom, word: w, sym: a}
+	switch {
+	case a == m.RightParen:
+		n.kind = fmtClose
+	case a == m.LeftParen:
+		n.kind = fmtList
+		p.open = append(p.open, w)
+		for {
+			k, err := p.parse(mexp)
+			if err != nil {
+				return nil, err
+			}
+			if k.kind == fmtClose {
+				n.close = k.word
+				break
+			}
+			n.kids = append(n.kids, k)
+		}
+		p.open = p.open[:len(p.open)-1]
+	case !mexp:
+	case a == m.DoubleQuote:
+		n.kind = fmtPrefix
+		return p.args(n, false)
+	case head && m.IsCommand(a):
+		n.kind = fmtApp
+		mexps := make([]bool, m.commandArgs(a)-1)
+		for i := 1; i < len(mexps); i++ {
+			mexps[i] = true
+		}
+		return p.args(n, mexps...)
+	case a == m.SymQuote:
+		n.kind = fmtPrefix
+		return p.args(n, true)
+	case m.PrimArgs(a) > 0:
+		n.kind = fmtApp
+		mexps := make([]bool, m.PrimArgs(a)-1)
+		for i := range mexps {
+			mexps[i] = true
+		}
+		return p.args(n, mexps...)
+	}
+	return n, nil
+}
+
+// args reads the arguments of n, one for each entry of mexps.
+func (p *fmtParser) args(n *fmtNode, mexps ...bool) (*fmtNode, error) {
+	p.open = append(p.open, n.word)
+	for _, mexp := range mexps {
+		k, err := p.parse(mexp)
+		if err != nil {
+			return nil, err
+		}
+		n.kids = append(n.kids, k)
+	}
+	p.open = p.open[:len(p.open)-1]
+	return n, nil
+}
+
+// declare applies a top-level arity declaration, so that the rest of the
+// file is laid out with the arity the reader will use.
+func (p *fmtParser) declare(n *fmtNode) {
+	if n.kind != fmtApp || n.sym == Nil || n.sym != p.m.SymArity {
+		return
+	}
+	arity := Nil
+	if n.kids[1].kind == fmtAtom {
+		arity = n.kids[1].sym
+	}
+	p.m.DeclareArity(n.kids[0].sym, arity)
+}
+
+type fmtPrinter struct {
+	m     *Machine
+	buf   bytes.Buffer
+	width int
+	col   int
+	lines int
+	bol   bool // nothing but indentation on the current line
+	broke bool // a trailing comment ended the line
+}
+
+func (p *fmtPrinter) text(s string) {
+	p.buf.WriteString(s)
+	p.bol = false
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		p.lines += strings.Count(s, "\n")
+		p.col = textWidth(s[i+1:])
+	} else {
+		p.col += textWidth(s)
+	}
+}
+
+func (p *fmtPrinter) newline(indent int) {
+	b := bytes.TrimRight(p.buf.Bytes(), " ")
+	p.buf.Truncate(len(b))
+	p.buf.WriteByte('\n')
+	p.buf.WriteString(strings.Repeat(" ", indent))
+	p.col = indent
+	p.lines++
+	p.bol = true
+	p.broke = false
+}
+
+// sep separates two words on a line, unless a comment has ended the line.
+func (p *fmtPrinter) sep(indent int) {
+	if p.broke {
+		p.newline(indent)
+	} else {
+		p.text(" ")
+	}
+}
+
+// adjoin puts the next word right after the previous one, unless a comment
+// has ended the line.
+func (p *fmtPrinter) adjoin(indent int) {
+	if p.broke {
+		p.newline(indent)
+	}
+}
+
+func (p *fmtPrinter) lead(w *Word, indent int) {
+	if len(w.Lead) == 0 {
+		return
+	}
+	if !p.bol {
+		p.newline(indent)
+	}
+	for i, c := range w.Lead {
+		if i > 0 && c.BlankBefore && indent == 0 {
+			p.newline(indent)
+		}
+		p.text(c.Text)
+		if c.OwnLine {
+			p.newline(indent)
+		} else {
+			p.text(" ")
+		}
+	}
+	w.Lead = nil
+}
+
+func (p *fmtPrinter) trail(w *Word) {
+	for _, c := range w.Trail {
+		p.text(" " + c.Text)
+		p.broke = true
+	}
+}
+
+func (p *fmtPrinter) word(w *Word, indent int) {
+	p.lead(w, indent)
+	p.text(w.Text)
+	p.trail(w)
+}
+
+// flat renders n on one line, or reports that comments inside n prevent it.
+func (p *fmtPrinter) flat(n *fmtNode) (string, bool) {
+	words := n.words(nil)
+	for i, w := range words {
+		if i > 0 && len(w.Lead) > 0 || i < len(words)-1 && len(w.Trail) > 0 {
+			return "", false
+		}
+	}
+	return p.flatText(n), true
+}
+
+func (p *fmtPrinter) flatText(n *fmtNode) string {
+	var parts []string
+	for _, k := range n.kids {
+		parts = append(parts, p.flatText(k))
+	}
+	switch n.kind {
+	case fmtList:
+		return "(" + strings.Join(parts, " ") + ")"
+	case fmtPrefix:
+		return n.word.Text + parts[0]
+	case fmtApp:
+		return strings.Join(append([]string{n.word.Text}, parts...), " ")
+	}
+	return n.word.Text
+}
+
+// chain reports whether n is a definition, lambda, if or let whose last
+// argument is an if or a let. Such chains always go down the page.
+func (p *fmtPrinter) chain(n *fmtNode) bool {
+	isChain := func(n *fmtNode) bool {
+		return n.kind == fmtApp && (n.sym == p.m.SymIf || n.sym == p.m.SymLet)
+	}
+	if n.kind != fmtApp || len(n.kids) == 0 {
+		return false
+	}
+	if !isChain(n) && n.sym != p.m.SymDefine && n.sym != p.m.SymLambda {
+		return false
+	}
+	return isChain(n.kids[len(n.kids)-1])
+}
+
+// fits reports whether n can go flat on the current line after a space.
+func (p *fmtPrinter) fits(n *fmtNode) bool {
+	s, ok := p.flat(n)
+	return ok && !p.chain(n) && !p.broke && p.col+1+textWidth(s) <= p.width
+}
+
+func (p *fmtPrinter) node(n *fmtNode, indent int) {
+	p.lead(n.first(), indent)
+	if s, ok := p.flat(n); ok && !p.chain(n) && p.col+textWidth(s) <= p.width {
+		p.text(s)
+		p.trail(n.last())
+		return
+	}
+	col := p.col
+	switch n.kind {
+	case fmtAtom, fmtClose:
+		p.word(n.word, indent)
+	case fmtPrefix:
+		p.word(n.word, col)
+		p.adjoin(col + 1)
+		p.node(n.kids[0], col+1)
+	case fmtList:
+		p.word(n.word, col)
+		for i, k := range n.kids {
+			lines := p.lines
+			switch {
+			case i == 0:
+				p.adjoin(col + 1)
+			case p.fits(k):
+				p.sep(col + 1)
+			default:
+				p.newline(col + 1)
+			}
+			p.node(k, col+1)
+			if p.lines != lines && i < len(n.kids)-1 && !p.broke {
+				p.newline(col + 1)
+			}
+		}
+		p.adjoin(col)
+		p.word(n.close, col)
+	case fmtApp:
+		p.app(n, col)
+	}
+}
+
+// app lays out an application that does not fit on one line. Definitions
+// indent their body; if, let and cons continue with their last argument at
+// the column of the head, so that chains of them read down the page.
+func (p *fmtPrinter) app(n *fmtNode, col int) {
+	m := p.m
+	p.word(n.word, col)
+	kids := n.kids
+	switch {
+	case n.sym == m.SymDefine || n.sym == m.SymLambda:
+		p.sep(col + 3)
+		p.node(kids[0], col+3)
+		p.newline(col + 3)
+		p.node(kids[1], col+3)
+	case n.sym == m.SymIf:
+		p.sep(col + 3)
+		lines := p.lines
+		p.node(kids[0], col+3)
+		if p.lines == lines && p.fits(kids[1]) {
+			p.sep(col + 3)
+		} else {
+			p.newline(col + 3)
+		}
+		p.node(kids[1], col+3)
+		p.newline(col)
+		p.node(kids[2], col)
+	case n.sym == m.SymLet:
+		p.sep(col + 4)
+		lines := p.lines
+		p.node(kids[0], col+4)
+		if p.lines == lines && p.fits(kids[1]) {
+			p.sep(col + 4)
+		} else {
+			p.newline(col + 4)
+		}
+		p.node(kids[1], col+4)
+		p.newline(col)
+		p.node(kids[2], col)
+	case m.PrimCode(n.sym) == PrimCons:
+		p.sep(col + 5)
+		p.node(kids[0], col+5)
+		p.newline(col)
+		p.node(kids[1], col)
+	case len(kids) == 1:
+		p.sep(col + 3)
+		p.node(kids[0], col+3)
+	default:
+		onHead := true
+		for _, k := range kids {
+			if onHead && p.fits(k) {
+				p.sep(col + 3)
+			} else {
+				onHead = false
+				p.newline(col + 3)
+			}
+			p.node(k, col+3)
+		}
+	}
+}
+
+// parseForms reads words into top-level forms the way the reader of m
+// would, applying arity declarations as it goes. Running out of storage is
+// a SyntaxError at the form being read.
+func parseForms(m *Machine, words []*Word) (forms []*fmtNode, err error) {
+	parser := &fmtParser{m: m, words: words}
+	defer func() {
+		if r := recover(); r != nil {
+			if r != errStorageOverflow {
+				panic(r)
+			}
+			w := parser.open[0]
+			forms, err = nil, &SyntaxError{w.Line, w.Col, "storage overflow reading this form"}
+		}
+	}()
+	for parser.next < len(words) {
+		parser.open = []*Word{words[parser.next]}
+		parser.head = true
+		n, err := parser.parse(true)
+		if err != nil {
+			return nil, err
+		}
+		parser.declare(n)
+		forms = append(forms, n)
+	}
+	return forms, nil
+}
+
+// CheckSyntax reports where src cannot be read to the end: an unclosed
+// comment, or a form left incomplete at the end of the file. A source too
+// large to check is left to the run, whose heap may be larger.
+func CheckSyntax(src []byte) error {
+	f, err := ParseSource(src)
+	if err != nil {
+		return err
+	}
+	m := NewMachine(strings.NewReader(""), io.Discard)
+	m.Init()
+	if _, err = parseForms(m, f.Words); m.NextFree >= len(m.Nodes) {
+		return nil
+	}
+	return err
+}
+
+// Format lays out the M-expression source src. It fails if src cannot be
+// read to the end, and never returns output that reads differently.
+func Format(src []byte, width int) ([]byte, error) {
+	f, err := ParseSource(src)
+	if err != nil {
+		return nil, err
+	}
+	m := NewMachine(strings.NewReader(""), io.Discard)
+	m.Init()
+	forms, err := parseForms(m, f.Words)
+	if err != nil {
+		return nil, err
+	}
+	p := &fmtPrinter{m: m, width: width, bol: true}
+	for _, n := range forms {
+		first := n.first()
+		if p.buf.Len() > 0 {
+			p.newline(0)
+			if first.BlankBefore {
+				p.newline(0)
+			}
+		}
+		p.node(n, 0)
+	}
+	for _, c := range f.Trailer {
+		if p.buf.Len() > 0 {
+			p.newline(0)
+			if c.BlankBefore {
+				p.newline(0)
+			}
+		}
+		p.text(c.Text)
+	}
+	if p.buf.Len() > 0 {
+		p.newline(0)
+	}
+	out := p.buf.Bytes()
+	if !sameTokens(ScanTokens(src), ScanTokens(out)) {
+		return nil, fmt.Errorf("internal error: formatting changed the words of the program")
+	}
+	return out, nil
+}
+
+func sameTokens(a, b []Token) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Text != b[i].Text {
+			return false
+		}
+	}
+	return true
+}
+
+// fmtMain implements "lisp fmt".
+func fmtMain(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	check := flags.Bool("check", false, "list files that are not formatted and fail if there are any")
+	write := flags.Bool("w", false, "write the result to the file instead of standard output")
+	width := flags.Int("width", 72, "line width")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: lisp fmt [-check] [-w] [-width n] [file.l ...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	status := ExitSuccess
+	format := func(name string, src []byte) {
+		out, err := Format(src, *width)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%v\n", name, err)
+			status = ExitSyntax
+			return
+		}
+		switch {
+		case *check:
+			if !bytes.Equal(src, out) {
+				fmt.Println(name)
+				if status == ExitSuccess {
+					status = ExitFindings
+				}
+			}
+		case *write:
+			if !bytes.Equal(src, out) {
+				if err := os.WriteFile(name, out, 0666); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					status = ExitUsage
+				}
+			}
+		default:
+			os.Stdout.Write(out)
+		}
+	}
+
+	if flags.NArg() == 0 {
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitUsage
+		}
+		format("<stdin>", src)
+		return status
+	}
+	for _, name := range flags.Args() {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = ExitUsage
+			continue
+		}
+		format(name, src)
+	}
+	return status
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"empty", "", ""},
+		{"one line", "car '(a b)\n", "car '(a b)\n"},
+		{"spaces", "cons  'a   nil\n", "cons 'a nil\n"},
+		{"blank lines", "aa\n\n\n\nbb\n", "aa\n\nbb\n"},
+		{"comments", "[ a ]\naa [ b ]\n[ c ]\n", "[ a ]\naa [ b ]\n[ c ]\n"},
+		{"define", "define (f x)\ncons x\nnil\n", "define (f x) cons x nil\n"},
+		{"arity", "define (f x y) cons x cons y nil\narity f 2\nf 1 f 2 3\n", "define (f x y) cons x cons y nil\narity f 2\nf 1 f 2 3\n"},
+		{"command names as symbols", "define (f heap doc) cons heap doc\n'(trace break)\n", "define (f heap doc) cons heap doc\n'(trace break)\n"},
+		{"long", "define (f x) cons x cons x cons x cons x cons x cons x cons x cons x cons x nil\n",
+			"define (f x)\n   cons x cons x cons x cons x cons x cons x cons x cons x cons x nil\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Format([]byte(tt.src), 72)
+			if err != nil {
+				t.Fatalf("Format: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Format(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	for _, src := range []string{"[ open", "define (f x)", "cons 'a"} {
+		if _, err := Format([]byte(src), 72); err == nil {
+			t.Errorf("Format(%q) succeeded, want an error", src)
+		}
+	}
+}
+
+// TestFormatIdempotent formats the programs of the repository twice.
+func TestFormatIdempotent(t *testing.T) {
+	var names []string
+	for _, dir := range testDirs {
+		matches, _ := filepath.Glob(filepath.Join("..", dir, "*.l"))
+		names = append(names, matches...)
+	}
+	if len(names) == 0 {
+		t.Skip("no programs found")
+	}
+	for _, name := range names {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		once, err := Format(src, 72)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		twice, err := Format(once, 72)
+		if err != nil {
+			t.Errorf("%s: formatted: %v", name, err)
+			continue
+		}
+		if string(once) != string(twice) {
+			t.Errorf("%s: formatting is not idempotent", name)
+		}
+	}
+}
+
+func TestSameTokens(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"", "", true},
+		{"car '(a b)", "car\n  '( a b )", true},
+		{"aa [ c ] bb", "aa [ c ]\nbb", true},
+		{"aa bb", "aa bb cc", false},
+		{"aa bb", "aa cc", false},
+		{"[ a ] b", "[ a b ]", false},
+		{"ab", "a b", false},
+	}
+	for _, tt := range tests {
+		if got := sameTokens(ScanTokens([]byte(tt.a)), ScanTokens([]byte(tt.b))); got != tt.want {
+			t.Errorf("sameTokens(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// --- Heap Inspection ---
+
+// kindNames are the names of the Kinds of nodes.
+var kindNames = [...]string{KindCons: "cons", KindNumber: "number", KindAtom: "atom"}
+
+// HeapStats describes the nodes of the heap. A node is live if it can be
+// reached from the roots: the interned atoms, the tapes and displays of the
+// try calls in progress, the words the reader holds, and the applications
+// on Stack. During an evaluation the intermediate values Go holds are not
+// roots, so the live nodes are then an estimate from below.
+type HeapStats struct {
+	Size, Used  int        // the nodes of the heap, and those allocated
+	Kinds, Live [3]int     // the allocated and the live nodes, by Kind
+	Atoms       int        // the interned atoms
+	Bindings    int        // the conses of the value stacks of the atoms
+	Stacks      []HeapItem // the deepest value stacks, in bindings
+	Largest     []HeapItem // the largest structures, in nodes
+	Evals       int
+}
+
+// HeapItem is something in the heap with its size.
+type HeapItem struct {
+	Name string
+	Size int
+	Expr int
+}
+
+// Garbage returns the number of allocated nodes that are not live.
+func (s *HeapStats) Garbage() int {
+	return s.Used - s.Live[KindCons] - s.Live[KindNumber] - s.Live[KindAtom]
+}
+
+// heapMarker marks the nodes reachable from a node. Atoms are followed to
+// their names and values only when all is set, so that the size of a
+// structure does not include everything its symbols are bound to.
+type heapMarker struct {
+	m     *Machine
+	mark  []int // the generation a node was last marked in
+	gen   int
+	all   bool
+	count int
+	work  []int
+}
+
+func (h *heapMarker) reach(x int) {
+	m := h.m
+	h.work = append(h.work[:0], x)
+	for len(h.work) > 0 {
+		x := h.work[len(h.work)-1]
+		h.work = h.work[:len(h.work)-1]
+		if x < 0 || x >= m.NextFree || h.mark[x] == h.gen {
+			continue
+		}
+		n := &m.Nodes[x]
+		if n.Kind == KindAtom && !h.all {
+			continue
+		}
+		h.mark[x] = h.gen
+		h.count++
+		switch n.Kind {
+		case KindCons:
+			h.work = append(h.work, n.Car, n.Cdr)
+		case KindAtom:
+			h.work = append(h.work, n.Name, n.Val)
+		}
+	}
+}
+
+// HeapStats inspects the heap of m and lists the top deepest value stacks
+// and largest structures, or none if top is 0. It does not allocate nodes.
+func (m *Machine) HeapStats(top int) *HeapStats {
+	s := &HeapStats{Size: len(m.Nodes), Used: m.NextFree, Evals: m.TimeEval}
+	for i := range m.NextFree {
+		s.Kinds[m.Nodes[i].Kind]++
+	}
+	h := &heapMarker{m: m, mark: make([]int, m.NextFree), gen: 1, all: true}
+	roots := []int{Nil, m.ObjectList, m.Tapes, m.DisplayEnabled, m.CapturedDisplays, m.Q, m.Buffer2, m.InWordBuffer}
+	for _, f := range m.Stack {
+		roots = append(roots, f.Func, f.Args)
+	}
+	for _, x := range roots {
+		h.reach(x)
+	}
+	for i := range m.NextFree {
+		if h.mark[i] == h.gen {
+			s.Live[m.Nodes[i].Kind]++
+		}
+	}
+
+	// The structures are the values on the value stacks of the atoms,
+	// and the other roots; each counts the conses and numbers it reaches
+	// without going through an atom.
+	h.all = false
+	size := func(x int) int {
+		h.gen++
+		h.count = 0
+		h.reach(x)
+		return h.count
+	}
+	for o := m.ObjectList; !m.IsAtom(o); o = m.Cdr(o) {
+		a := m.Car(o)
+		s.Atoms++
+		depth := 0
+		for v := m.Value(a); !m.IsAtom(v); v = m.Cdr(v) {
+			depth++
+			if x := m.Car(v); top > 0 && !m.IsAtom(x) {
+				s.Largest = append(s.Largest, HeapItem{m.NameString(a), size(x), x})
+			}
+		}
+		s.Bindings += depth
+		if depth > 1 {
+			s.Stacks = append(s.Stacks, HeapItem{m.NameString(a), depth, Nil})
+		}
+	}
+	if top == 0 {
+		s.Stacks, s.Largest = nil, nil
+		return s
+	}
+	for _, r := range []struct {
+		name string
+		x    int
+	}{{"<tapes>", m.Tapes}, {"<displays>", m.CapturedDisplays}, {"<reader>", m.InWordBuffer}} {
+		if n := size(r.x); n > 0 {
+			s.Largest = append(s.Largest, HeapItem{r.name, n, r.x})
+		}
+	}
+	for _, f := range m.Stack {
+		if n := size(f.Args); n > 0 {
+			s.Largest = append(s.Largest, HeapItem{"<arguments of " + m.NameString(f.Name) + ">", n, f.Args})
+		}
+	}
+	bySize := func(items []HeapItem) []HeapItem {
+		sort.SliceStable(items, func(i, j int) bool { return items[i].Size > items[j].Size })
+		return items[:min(len(items), top)]
+	}
+	s.Stacks, s.Largest = bySize(s.Stacks), bySize(s.Largest)
+	return s
+}
+
+// Write writes a report of s to w, with the structures shown in Sexp form
+// shortened to width characters.
+func (s *HeapStats) Write(w io.Writer, m *Machine, width int) {
+	percent := func(n, of int) float64 {
+		return 100 * float64(n) / float64(max(of, 1))
+	}
+	fmt.Fprintf(w, "nodes    %d of %d used (%.1f%%), %d live, %d garbage\n", s.Used, s.Size, percent(s.Used, s.Size), s.Used-s.Garbage(), s.Garbage())
+	for k, name := range kindNames {
+		fmt.Fprintf(w, "%-8s %d, %d live\n", name, s.Kinds[k], s.Live[k])
+	}
+	fmt.Fprintf(w, "atoms    %d interned, %d bindings\n", s.Atoms, s.Bindings)
+	if len(s.Stacks) > 0 {
+		fmt.Fprintln(w, "deepest value stacks:")
+		for _, it := range s.Stacks {
+			fmt.Fprintf(w, "  %8d  %s\n", it.Size, it.Name)
+		}
+	}
+	if len(s.Largest) > 0 {
+		fmt.Fprintln(w, "largest structures:")
+		for _, it := range s.Largest {
+			fmt.Fprintf(w, "  %8d  %s = %s\n", it.Size, it.Name, shorten(m.SexpString(it.Expr), width))
+		}
+	}
+}
+
+// String returns a one-line summary of s, for the periodic memory report.
+func (s *HeapStats) String() string {
+	return fmt.Sprintf("evals %d, nodes %d of %d used (%.1f%%), %d live, %d garbage, %d atoms, %d bindings",
+		s.Evals, s.Used, s.Size, 100*float64(s.Used)/float64(max(s.Size, 1)), s.Used-s.Garbage(), s.Garbage(), s.Atoms, s.Bindings)
+}
+
+// heapCommand is the heap command: it reports on the heap, listing the n
+// deepest value stacks and largest structures, or 10 if n is not a number.
+func (m *Machine) heapCommand(n int) {
+	top := 10
+	if m.IsNumber(n) && m.ToBigInt(n).IsInt64() {
+		top = int(max(m.ToBigInt(n).Int64(), 0))
+	}
+	var b strings.Builder
+	m.HeapStats(top).Write(&b, m, backtraceWidth)
+	m.Out.Record("heap", n)
+	m.Out.Text("memory", strings.TrimSuffix(b.String(), "\n"))
+}
+
+// HeapReporter writes a one-line summary of the heap to W each time Every
+// more calls of eval have been made.
+type HeapReporter struct {
+	BaseHook
+	m     *Machine
+	W     io.Writer
+	Every int
+	next  int
+}
+
+// ReportHeap starts writing a summary of the heap to the ErrWriter of m
+// every n calls of eval.
+func (m *Machine) ReportHeap(n int) *HeapReporter {
+	r := &HeapReporter{m: m, W: m.ErrWriter, Every: n, next: m.TimeEval + n}
+	m.AddHook(r)
+	return r
+}
+
+func (r *HeapReporter) Enter(e int) {
+	if r.m.TimeEval >= r.next {
+		r.next = r.m.TimeEval + r.Every
+		fmt.Fprintf(r.W, "memory: %s\n", r.m.HeapStats(0))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeapStats(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup changes the heap of an initialized machine, and returns
+		// the live and garbage nodes it adds.
+		setup   func(m *Machine) (live, garbage int)
+		stacks  []string
+		largest []string
+	}{
+		{"unchanged", func(m *Machine) (int, int) { return 0, 0 }, nil, nil},
+		{"garbage", func(m *Machine) (int, int) {
+			m.List(m.SymTrue, m.SymFalse)
+			return 0, 2
+		}, nil, nil},
+		{"bound", func(m *Machine) (int, int) {
+			// The atom, its name, its value stack and its place in ObjectList,
+			// then a list of three conses bound to it.
+			x := m.MkAtom(PrimNone, "x", 0)
+			m.SetValue(x, m.Cons(m.List(m.SymTrue, m.List(m.SymFalse)), m.Value(x)))
+			return 1 + 1 + 1 + 1 + 3 + 1, 0
+		}, []string{"x 2"}, []string{"x 3 (true (false))"}},
+		{"arguments", func(m *Machine) (int, int) {
+			f, _ := m.LookupAtom("car")
+			m.Stack = append(m.Stack, Frame{Name: f, Func: f, Args: m.List(m.List(m.SymTrue))})
+			return 2, 0
+		}, nil, []string{"<arguments of car> 2 ((true))"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMachine(strings.NewReader(""), io.Discard)
+			m.Nodes = make([]Node, 2000)
+			if err := m.Run(); err != nil {
+				t.Fatal(err)
+			}
+			before := m.HeapStats(0)
+			live, garbage := tt.setup(m)
+			s := m.HeapStats(10)
+			if s.Size != 2000 || s.Used != m.NextFree {
+				t.Errorf("Size, Used = %d, %d, want 2000, %d", s.Size, s.Used, m.NextFree)
+			}
+			if got := s.Used - s.Garbage() - (before.Used - before.Garbage()); got != live {
+				t.Errorf("%d more live nodes, want %d", got, live)
+			}
+			if got := s.Garbage() - before.Garbage(); got != garbage {
+				t.Errorf("%d more garbage nodes, want %d", got, garbage)
+			}
+			var stacks, largest []string
+			for _, it := range s.Stacks {
+				stacks = append(stacks, it.Name+" "+fmt.Sprint(it.Size))
+			}
+			for _, it := range s.Largest {
+				if !strings.HasPrefix(it.Name, "<") || strings.HasPrefix(it.Name, "<arguments") {
+					largest = append(largest, it.Name+" "+fmt.Sprint(it.Size)+" "+m.SexpString(it.Expr))
+				}
+			}
+			if !reflect.DeepEqual(stacks, tt.stacks) || !reflect.DeepEqual(largest, tt.largest) {
+				t.Errorf("stacks %q, largest %q, want %q, %q", stacks, largest, tt.stacks, tt.largest)
+			}
+		})
+	}
+}
+
+func TestHeapReporter(t *testing.T) {
+	var out bytes.Buffer
+	m := NewMachine(strings.NewReader("define (f n) if = n 0 nil cons n (f - n 1)\n(f 10)\n"), io.Discard)
+	m.ReportHeap(20).W = &out
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if n := 20 * len(lines); n > m.TimeEval || m.TimeEval-n > 20 {
+		t.Errorf("%d reports in %d evals, want one every 20:\n%s", len(lines), m.TimeEval, out.String())
+	}
+	for i, l := range lines {
+		if want := fmt.Sprintf("memory: evals %d, nodes ", 20*(i+1)); !strings.HasPrefix(l, want) || !strings.Contains(l, " live, ") {
+			t.Errorf("report %q, want it to start with %q", l, want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+// --- Evaluation Hooks ---
+
+// EvalHook is told about the steps of Eval, for tools such as the tracer.
+// A hook must not allocate nodes, so that the cons counts of a run stay the
+// same with and without it.
+type EvalHook interface {
+	// Enter is called when Eval starts on e, and Leave when it returns v
+	// for e. A negative v is a failure such as out-of-time.
+	Enter(e int)
+	Leave(e, v int)
+	// Apply is called before the value f of the head of an expression is
+	// applied to the evaluated arguments args, and Return after it
+	// returned v. name is the symbol f was the value of, or Nil.
+	Apply(f, name, args int)
+	Return(f, name, args, v int)
+	// Branch is called when the if expression e takes its then branch, or
+	// its else branch if then is false.
+	Branch(e int, then bool)
+}
+
+// BaseHook does nothing; hooks embed it to handle only some steps.
+type BaseHook struct{}
+
+func (BaseHook) Enter(e int)                 {}
+func (BaseHook) Leave(e, v int)              {}
+func (BaseHook) Apply(f, name, args int)     {}
+func (BaseHook) Return(f, name, args, v int) {}
+func (BaseHook) Branch(e int, then bool)     {}
+
+// AddHook makes h observe the evaluation of m.
+func (m *Machine) AddHook(h EvalHook) {
+	m.hooks = append(m.hooks, h)
+}
+
+// RemoveHook stops h observing the evaluation of m.
+func (m *Machine) RemoveHook(h EvalHook) {
+	for i, x := range m.hooks {
+		if x == h {
+			m.hooks = append(m.hooks[:i:i], m.hooks[i+1:]...)
+			return
+		}
+	}
+}
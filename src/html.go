@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// --- HTML Transcripts ---
+
+// htmlOutput writes a run as a self-contained HTML page: the source of each
+// top-level form with its comments, its results, what it displays at any
+// depth of try, and what it cost. The body of a define is folded away.
+type htmlOutput struct {
+	m     *Machine
+	Title string
+
+	items []htmlItem // the records and events of the current form
+}
+
+// htmlItem is a record or an event of a form, in the order it happened.
+type htmlItem struct {
+	label, text string
+	depth       int
+	event       bool
+}
+
+const htmlStyle = `
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; padding: 0 1em; color: #222; }
+h1 { font-size: 1.4em; }
+pre, code { font-family: monospace; font-size: 0.95em; }
+pre { margin: 0.3em 0; white-space: pre-wrap; }
+.form { border-left: 3px solid #ccd; margin: 1em 0; padding: 0.2em 0.8em; }
+.define { border-left-color: #9b9; }
+.lead { color: #555; }
+.comment { color: #777; font-style: italic; }
+summary { cursor: pointer; }
+.doc { color: #555; margin-left: 1em; }
+.records { margin: 0.4em 0; }
+.record { display: flex; gap: 1em; }
+.label { flex: 0 0 7em; color: #557; }
+.value { white-space: pre-wrap; word-break: break-all; }
+.event .label { color: #a60; }
+.event.captured { opacity: 0.7; }
+.cost { color: #888; font-size: 0.85em; }
+.total { border-top: 1px solid #ccc; margin-top: 2em; padding-top: 0.5em; }
+.overflow { color: #a22; font-weight: bold; }
+`
+
+func (o *htmlOutput) Start() {
+	title := o.Title
+	if title == "" {
+		title = "LISP Interpreter Run"
+	}
+	fmt.Fprintf(o.m.Writer, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n<style>%s</style>\n</head>\n<body>\n<h1>%s</h1>\n",
+		html.EscapeString(title), htmlStyle, html.EscapeString(title))
+}
+
+func (o *htmlOutput) Echo(c int) {}
+func (o *htmlOutput) BeginForm() {}
+func (o *htmlOutput) Read()      {}
+
+func (o *htmlOutput) Record(label string, x int) {
+	o.items = append(o.items, htmlItem{label: label, text: o.m.SexpString(x)})
+}
+
+func (o *htmlOutput) Text(label, text string) {
+	o.items = append(o.items, htmlItem{label: label, text: text})
+}
+
+func (o *htmlOutput) Event(e Event) {
+	o.items = append(o.items, htmlItem{e.Label, o.m.SexpString(e.X), e.Depth, true})
+}
+
+func (o *htmlOutput) EndForm(f *Form) {
+	m := o.m
+	w := m.Writer
+	if lead := strings.Trim(string(m.Source[m.lastFormEnd:m.formStart]), "\n"); strings.TrimSpace(lead) != "" {
+		fmt.Fprintf(w, "<pre class=\"lead\">%s</pre>\n", htmlSource(lead))
+	}
+	cost := fmt.Sprintf("<span class=\"cost\">%d evals, %d conses, %v</span>", f.Evals, f.Conses, f.Time.Round(time.Microsecond))
+	if f.Define {
+		fmt.Fprintf(w, "<details class=\"form define\">\n<summary><code>define %s</code>", html.EscapeString(m.SexpString(f.Name)))
+		if doc := m.docs[f.Name]; doc != "" {
+			fmt.Fprintf(w, "<span class=\"doc\">%s</span>", html.EscapeString(doc))
+		}
+		fmt.Fprintf(w, " %s</summary>\n", cost)
+	} else {
+		fmt.Fprintf(w, "<div class=\"form\">\n")
+	}
+	fmt.Fprintf(w, "<pre class=\"source\">%s</pre>\n", htmlSource(f.Source))
+	o.writeRecords()
+	if f.Define {
+		fmt.Fprintf(w, "</details>\n")
+	} else {
+		fmt.Fprintf(w, "%s\n</div>\n", cost)
+	}
+}
+
+// writeRecords writes the records and events of the current form, and
+// forgets them.
+func (o *htmlOutput) writeRecords() {
+	w := o.m.Writer
+	fmt.Fprintf(w, "<div class=\"records\">\n")
+	for _, it := range o.items {
+		class := "record"
+		label := it.label
+		if it.event {
+			class += " event"
+			if it.depth > 0 {
+				class += " captured"
+				label = fmt.Sprintf("%s (try %d)", it.label, it.depth)
+			}
+		}
+		fmt.Fprintf(w, "<div class=\"%s\" style=\"margin-left: %dem\"><span class=\"label\">%s</span><span class=\"value\">%s</span></div>\n",
+			class, 2*it.depth, html.EscapeString(label), html.EscapeString(it.text))
+	}
+	fmt.Fprintf(w, "</div>\n")
+	o.items = o.items[:0]
+}
+
+func (o *htmlOutput) End(s *Summary) {
+	m := o.m
+	if trailer := strings.Trim(string(m.Source[m.formEnd:]), "\n"); !s.Overflow && strings.TrimSpace(trailer) != "" {
+		fmt.Fprintf(m.Writer, "<pre class=\"lead\">%s</pre>\n", htmlSource(trailer))
+	}
+	if s.Overflow {
+		// The form that used up the heap never ended: show what it
+		// recorded, as the classic transcript does.
+		if len(o.items) > 0 {
+			fmt.Fprintf(m.Writer, "<div class=\"form\">\n")
+			o.writeRecords()
+			fmt.Fprintf(m.Writer, "</div>\n")
+		}
+		fmt.Fprintf(m.Writer, "<p class=\"overflow\">Storage overflow!</p>\n")
+	}
+	fmt.Fprintf(m.Writer, "<p class=\"total\">Calls to eval = %d<br>Calls to cons = %d</p>\n</body>\n</html>\n", s.Evals, s.Conses)
+}
+
+// htmlSource returns source as HTML, with its bracketed comments marked.
+func htmlSource(source string) string {
+	var b strings.Builder
+	depth, start := 0, 0
+	for i := 0; i < len(source); i++ {
+		switch source[i] {
+		case '[':
+			if depth == 0 {
+				b.WriteString(html.EscapeString(source[start:i]))
+				start = i
+			}
+			depth++
+		case ']':
+			if depth == 0 {
+				continue
+			}
+			depth--
+			if depth == 0 {
+				fmt.Fprintf(&b, "<span class=\"comment\">%s</span>", html.EscapeString(source[start:i+1]))
+				start = i + 1
+			}
+		}
+	}
+	if depth > 0 {
+		fmt.Fprintf(&b, "<span class=\"comment\">%s</span>", html.EscapeString(source[start:]))
+	} else {
+		b.WriteString(html.EscapeString(source[start:]))
+	}
+	return b.String()
+}
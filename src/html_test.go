@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHTMLOutput(t *testing.T) {
+	tests := []struct {
+		name, src string
+		heap      int
+		want      string // the body of the page, with the times as T
+	}{
+		{
+			name: "forms",
+			src:  "[ wraps x ]\ndefine (f x)\n   cons x nil\n(f '<a&b>)\ntry 10 'display car '(c) nil\n",
+			heap: Size,
+			want: "" +
+				"<h1>LISP Interpreter Run</h1>\n" +
+				"<pre class=\"lead\"><span class=\"comment\">[ wraps x ]</span></pre>\n" +
+				"<details class=\"form define\">\n" +
+				"<summary><code>define f</code><span class=\"doc\">wraps x</span> <span class=\"cost\">0 evals, 104 conses, T</span></summary>\n" +
+				"<pre class=\"source\">define (f x)\n   cons x nil</pre>\n" +
+				"<div class=\"records\">\n" +
+				"<div class=\"record\" style=\"margin-left: 0em\"><span class=\"label\">define</span><span class=\"value\">f</span></div>\n" +
+				"<div class=\"record\" style=\"margin-left: 0em\"><span class=\"label\">value</span><span class=\"value\">(lambda (x) (cons x nil))</span></div>\n" +
+				"</div>\n" +
+				"</details>\n" +
+				"<div class=\"form\">\n" +
+				"<pre class=\"source\">(f &#39;&lt;a&amp;b&gt;)</pre>\n" +
+				"<div class=\"records\">\n" +
+				"<div class=\"record\" style=\"margin-left: 0em\"><span class=\"label\">expression</span><span class=\"value\">(f (&#39; &lt;a&amp;b&gt;))</span></div>\n" +
+				"<div class=\"record\" style=\"margin-left: 0em\"><span class=\"label\">value</span><span class=\"value\">(&lt;a&amp;b&gt;)</span></div>\n" +
+				"</div>\n" +
+				"<span class=\"cost\">8 evals, 43 conses, T</span>\n" +
+				"</div>\n" +
+				"<div class=\"form\">\n" +
+				"<pre class=\"source\">try 10 &#39;display car &#39;(c) nil</pre>\n" +
+				"<div class=\"records\">\n" +
+				"<div class=\"record\" style=\"margin-left: 0em\"><span class=\"label\">expression</span><span class=\"value\">(try 10 (&#39; (display (car (&#39; (c))))) nil)</span></div>\n" +
+				"<div class=\"record event captured\" style=\"margin-left: 2em\"><span class=\"label\">display (try 1)</span><span class=\"value\">c</span></div>\n" +
+				"<div class=\"record\" style=\"margin-left: 0em\"><span class=\"label\">value</span><span class=\"value\">(success c (c))</span></div>\n" +
+				"</div>\n" +
+				"<span class=\"cost\">12 evals, 150 conses, T</span>\n" +
+				"</div>\n" +
+				"<p class=\"total\">Calls to eval = 20<br>Calls to cons = 648</p>\n" +
+				"</body>\n</html>\n",
+		},
+		{
+			// The form that uses up the heap shows what it recorded.
+			name: "storage overflow",
+			src:  "car '(a)\ndefine (f n) cons n (f n)\n(f 'a)\n",
+			heap: 1000,
+			want: "" +
+				"<h1>LISP Interpreter Run</h1>\n" +
+				"<div class=\"form\">\n" +
+				"<pre class=\"source\">car &#39;(a)</pre>\n" +
+				"<div class=\"records\">\n" +
+				"<div class=\"record\" style=\"margin-left: 0em\"><span class=\"label\">expression</span><span class=\"value\">(car (&#39; (a)))</span></div>\n" +
+				"<div class=\"record\" style=\"margin-left: 0em\"><span class=\"label\">value</span><span class=\"value\">a</span></div>\n" +
+				"</div>\n" +
+				"<span class=\"cost\">4 evals, 36 conses, T</span>\n" +
+				"</div>\n" +
+				"<details class=\"form define\">\n" +
+				"<summary><code>define f</code> <span class=\"cost\">0 evals, 79 conses, T</span></summary>\n" +
+				"<pre class=\"source\">define (f n) cons n (f n)</pre>\n" +
+				"<div class=\"records\">\n" +
+				"<div class=\"record\" style=\"margin-left: 0em\"><span class=\"label\">define</span><span class=\"value\">f</span></div>\n" +
+				"<div class=\"record\" style=\"margin-left: 0em\"><span class=\"label\">value</span><span class=\"value\">(lambda (n) (cons n (f n)))</span></div>\n" +
+				"</div>\n" +
+				"</details>\n" +
+				"<div class=\"form\">\n" +
+				"<div class=\"records\">\n" +
+				"<div class=\"record\" style=\"margin-left: 0em\"><span class=\"label\">expression</span><span class=\"value\">(f (&#39; a))</span></div>\n" +
+				"</div>\n" +
+				"</div>\n" +
+				"<p class=\"overflow\">Storage overflow!</p>\n" +
+				"<p class=\"total\">Calls to eval = 1532<br>Calls to cons = 1000</p>\n" +
+				"</body>\n</html>\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			m := NewMachine(strings.NewReader(tt.src), &out)
+			m.Nodes = make([]Node, tt.heap)
+			m.Out = outputs["html"](m)
+			m.Run()
+			_, body, _ := strings.Cut(out.String(), "</head>\n<body>\n")
+			if got := durations.ReplaceAllString(body, " T"); got != tt.want {
+				t.Errorf("HTML\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
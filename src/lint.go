@@ -0,0 +1,391 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// --- Linting ---
+
+// Finding is a problem lint found at a position of the source of a program.
+type Finding struct {
+	Off int
+	Msg string
+}
+
+// linter walks the forms of a program as evaluation would see them. Since
+// bindings are dynamic, a function may use a symbol that is bound where it
+// is called rather than around it, so a symbol counts as bound if a lambda
+// binds it anywhere in the program. The expression of a try or eval that is
+// quoted in place is code too, but it is evaluated without the bindings
+// and definitions around it, so there only the lambdas in that expression
+// count.
+type linter struct {
+	p        *Program
+	m        *Machine
+	defs     map[int][]ProgramForm // the defines of each symbol, in order
+	bound    map[int]bool          // the symbols lambdas bind
+	uses     map[int]int
+	current  int // the symbol whose define is being walked, or Nil
+	start    int // where the form being walked starts
+	findings []Finding
+	seen     map[Finding]bool
+}
+
+// lintScope holds the symbols bound by the lambdas around an expression,
+// with the number of parameters of those bound to a lambda, or -1. For the
+// code of a try or eval, bound holds the symbols lambdas bind in it.
+type lintScope struct {
+	parent *lintScope
+	names  map[int]int
+	bound  map[int]bool
+}
+
+func (sc *lintScope) lookup(x int) (int, bool) {
+	for ; sc != nil; sc = sc.parent {
+		if n, ok := sc.names[x]; ok {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// clean returns the symbols bound in the code of the innermost try or eval
+// around sc, or nil outside them.
+func (sc *lintScope) clean() map[int]bool {
+	for ; sc != nil; sc = sc.parent {
+		if sc.bound != nil {
+			return sc.bound
+		}
+	}
+	return nil
+}
+
+// Lint checks a program for symbols that are never defined or bound, calls
+// of functions with the wrong number of arguments, parameters that shadow a
+// built-in symbol, and definitions that are never used. The findings are in
+// order of position.
+func Lint(p *Program) []Finding {
+	m := p.M
+	l := &linter{p: p, m: m, defs: map[int][]ProgramForm{}, bound: map[int]bool{}, uses: map[int]int{}, seen: map[Finding]bool{}}
+	for _, f := range p.Forms {
+		if f.Name != Nil {
+			l.defs[f.Name] = append(l.defs[f.Name], f)
+			for vars := f.Params; !m.IsAtom(vars); vars = m.Cdr(vars) {
+				l.bound[m.Car(vars)] = true
+			}
+		}
+		l.binders(f.Expr, l.bound)
+	}
+	for _, f := range p.Forms {
+		e := f.Expr
+		l.start = f.Start
+		switch {
+		case m.IsAtom(e):
+			l.expr(e, nil, f.Start)
+		case f.Name != Nil:
+			l.current = f.Name
+			if f.Function {
+				l.lambda(f.Params, f.Def, nil, nil, f.Start)
+			} else {
+				l.data(f.Def)
+			}
+			l.current = Nil
+		case f.Command:
+		default:
+			l.expr(e, nil, f.Start)
+		}
+	}
+	for _, f := range p.Forms {
+		if defs := l.defs[f.Name]; f.Name != Nil && l.uses[f.Name] == 0 && defs[len(defs)-1].Start == f.Start {
+			off := f.Start
+			if t, ok := p.NameToken(f); ok {
+				off = t.Off
+			}
+			l.report(off, "%s is defined but never used", m.NameString(f.Name))
+		}
+	}
+	sort.SliceStable(l.findings, func(i, j int) bool { return l.findings[i].Off < l.findings[j].Off })
+	return l.findings
+}
+
+func (l *linter) report(off int, format string, args ...any) {
+	f := Finding{off, fmt.Sprintf(format, args...)}
+	if !l.seen[f] {
+		l.seen[f] = true
+		l.findings = append(l.findings, f)
+	}
+}
+
+// at returns the offset of the word x, looking from the start of the list
+// it is in, at off.
+func (l *linter) at(x, off int) int {
+	name := l.m.NameString(x)
+	src := l.m.Source
+	for _, t := range ScanTokens(src[off:]) {
+		if t.Text == name {
+			return off + t.Off
+		}
+	}
+	return off
+}
+
+// def returns the define of x in effect for the form being walked: the last
+// one before it, or else the first one after it.
+func (l *linter) def(x int) (ProgramForm, bool) {
+	defs := l.defs[x]
+	if len(defs) == 0 {
+		return ProgramForm{}, false
+	}
+	i := sort.Search(len(defs), func(i int) bool { return defs[i].Start > l.start })
+	return defs[max(i-1, 0)], true
+}
+
+func (l *linter) use(x int) {
+	if x != l.current {
+		l.uses[x]++
+	}
+}
+
+// binders adds the symbols that the lambdas in x bind to bound, and those
+// in vars, the parameters of a define.
+func (l *linter) binders(x int, bound map[int]bool) {
+	m := l.m
+	if m.IsAtom(x) {
+		return
+	}
+	if m.Car(x) == m.SymLambda {
+		for vars := m.Car(m.Cdr(x)); !m.IsAtom(vars); vars = m.Cdr(vars) {
+			bound[m.Car(vars)] = true
+		}
+	}
+	for ; !m.IsAtom(x); x = m.Cdr(x) {
+		l.binders(m.Car(x), bound)
+	}
+}
+
+// data counts the defined symbols in x, which may yet be evaluated.
+func (l *linter) data(x int) {
+	m := l.m
+	if m.IsAtom(x) {
+		if _, ok := l.defs[x]; ok {
+			l.use(x)
+		}
+		return
+	}
+	for ; !m.IsAtom(x); x = m.Cdr(x) {
+		l.data(m.Car(x))
+	}
+}
+
+// quoted returns the expression x quotes, if it is a quotation.
+func (l *linter) quoted(x int) (int, bool) {
+	m := l.m
+	if m.IsAtom(x) || m.Car(x) != m.SymQuote {
+		return Nil, false
+	}
+	return m.Car(m.Cdr(x)), true
+}
+
+// isLambda reports whether x is a lambda expression, quoted or not, and
+// returns it unquoted.
+func (l *linter) isLambda(x int) (int, bool) {
+	m := l.m
+	if q, ok := l.quoted(x); ok {
+		x = q
+	}
+	return x, !m.IsAtom(x) && m.Car(x) == m.SymLambda
+}
+
+func params(m *Machine, vars int) int {
+	n := 0
+	for ; !m.IsAtom(vars); vars = m.Cdr(vars) {
+		n++
+	}
+	return n
+}
+
+// ref checks the symbol x, evaluated in sc.
+func (l *linter) ref(x int, sc *lintScope, off int) {
+	m := l.m
+	if m.IsNumber(x) || m.IsBuiltin(x) {
+		return
+	}
+	if _, ok := sc.lookup(x); ok {
+		return
+	}
+	_, defined := l.defs[x]
+	if defined {
+		l.use(x)
+	}
+	bound := sc.clean()
+	switch {
+	case bound != nil && bound[x]:
+	case bound != nil && defined:
+		l.report(l.at(x, off), "%s is defined, but try and eval do not see definitions, so here it evaluates to itself", m.NameString(x))
+	case bound == nil && (defined || l.bound[x]):
+	default:
+		l.report(l.at(x, off), "%s is never defined or bound, so it evaluates to itself", m.NameString(x))
+	}
+}
+
+// expr checks the expression e, evaluated in sc. off is where the list
+// around it starts.
+func (l *linter) expr(e int, sc *lintScope, off int) {
+	m := l.m
+	if m.IsAtom(e) {
+		l.ref(e, sc, off)
+		return
+	}
+	if pos, ok := m.Positions[e]; ok {
+		off = pos
+	}
+	head, args := m.Car(e), m.Cdr(e)
+	switch {
+	case head == m.SymQuote:
+		if x, ok := l.isLambda(m.Car(args)); ok {
+			l.lambda(m.Car(m.Cdr(x)), m.Car(m.Cdr(m.Cdr(x))), nil, sc, off)
+		} else {
+			l.data(m.Car(args))
+		}
+		return
+	case head == m.SymLambda:
+		l.lambda(m.Car(args), m.Car(m.Cdr(args)), nil, sc, off)
+		return
+	case head == m.SymEval || head == m.SymTry:
+		code := args
+		if head == m.SymTry {
+			l.expr(m.Car(args), sc, off)
+			code = m.Cdr(args)
+		}
+		if x, ok := l.quoted(m.Car(code)); ok {
+			bound := map[int]bool{}
+			l.binders(x, bound)
+			l.expr(x, &lintScope{names: map[int]int{}, bound: bound}, off)
+		} else {
+			l.expr(m.Car(code), sc, off)
+		}
+		for a := m.Cdr(code); !m.IsAtom(a); a = m.Cdr(a) {
+			l.expr(m.Car(a), sc, off)
+		}
+		return
+	}
+	given := params(m, args)
+	if x, ok := l.isLambda(head); ok {
+		// An application of a lambda in place, as let reads: the
+		// parameters bound to lambdas have their number of arguments.
+		vars := m.Car(m.Cdr(x))
+		if n := params(m, vars); n != given {
+			l.report(off, "this lambda takes %s, but is given %d", plural(n, "argument"), given)
+		}
+		// A lambda bound to a parameter is called where the parameter
+		// is bound, so it sees itself, as a recursive function does.
+		var arities []int
+		v := vars
+		for a := args; !m.IsAtom(a); a = m.Cdr(a) {
+			n, inner := -1, sc
+			if f, ok := l.isLambda(m.Car(a)); ok {
+				n = params(m, m.Car(m.Cdr(f)))
+				if !m.IsAtom(v) && m.IsAtom(m.Car(v)) {
+					inner = &lintScope{parent: sc, names: map[int]int{m.Car(v): n}}
+				}
+			}
+			l.expr(m.Car(a), inner, off)
+			arities = append(arities, n)
+			if !m.IsAtom(v) {
+				v = m.Cdr(v)
+			}
+		}
+		l.lambda(vars, m.Car(m.Cdr(m.Cdr(x))), arities, sc, off)
+		return
+	}
+	if m.IsAtom(head) && !m.IsBuiltin(head) {
+		n, bound := sc.lookup(head)
+		if f, ok := l.def(head); !bound && ok && f.Function && sc.clean() == nil {
+			n, bound = params(m, f.Params), true
+		}
+		if bound && n >= 0 && n != given {
+			l.report(l.at(head, off), "%s takes %s, but is given %d", m.NameString(head), plural(n, "argument"), given)
+		}
+	}
+	for x := e; !m.IsAtom(x); x = m.Cdr(x) {
+		l.expr(m.Car(x), sc, off)
+	}
+}
+
+// lambda checks a lambda with parameters vars and body body, evaluated in
+// sc. arities gives the number of arguments of the parameters that are
+// bound to lambdas, or -1.
+func (l *linter) lambda(vars, body int, arities []int, sc *lintScope, off int) {
+	m := l.m
+	inner := &lintScope{parent: sc, names: map[int]int{}}
+	for i := 0; !m.IsAtom(vars); vars, i = m.Cdr(vars), i+1 {
+		v := m.Car(vars)
+		if !m.IsAtom(v) {
+			l.report(off, "parameter %s is a list, so it binds nothing", m.SexpString(v))
+			continue
+		}
+		if m.IsNumber(v) {
+			continue
+		}
+		if v < m.Builtins {
+			l.report(l.at(v, off), "parameter %s shadows the built-in %s", m.NameString(v), m.NameString(v))
+		}
+		inner.names[v] = -1
+		if i < len(arities) {
+			inner.names[v] = arities[i]
+		}
+	}
+	l.expr(body, inner, off)
+}
+
+// lintMain is the lint subcommand: it checks the programs in the files,
+// read one after the other as a run reads them.
+func lintMain(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: lisp lint file.l ...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return ExitUsage
+	}
+	src, files, status := readFiles(fs.Args())
+	if status != ExitSuccess {
+		return status
+	}
+	p := ReadProgram(src)
+	if e, ok := p.Err.(*SyntaxError); ok {
+		name, line := fileLine(files, e.Line)
+		fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n", name, line, e.Col, e.Msg)
+		if p.Overflow {
+			return ExitResources
+		}
+		return ExitSyntax
+	}
+	findings := Lint(p)
+	for _, f := range findings {
+		line, col := sourcePos(p.M.Source, f.Off)
+		name, line := fileLine(files, line)
+		fmt.Printf("%s:%d:%d: %s\n", name, line, col, f.Msg)
+	}
+	if len(findings) > 0 {
+		return ExitFindings
+	}
+	return ExitSuccess
+}
+
+// fileLine returns the file and the line in it of a line of the input
+// readFiles joined from files.
+func fileLine(files []inputFile, line int) (string, int) {
+	for i := len(files) - 1; i >= 0; i-- {
+		if line >= files[i].line {
+			return files[i].name, line - files[i].line + 1
+		}
+	}
+	return "<input>", line
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name, src string
+		want      []string // line:col message
+	}{
+		{"clean", "define (f x) cons x nil\n(f 'a)\n", nil},
+		{"arguments", "define (f x) cons x nil\n(f 'a 'b)\n", []string{
+			"2:2 f takes 1 argument, but is given 2",
+		}},
+		{"lambda arguments", "('lambda (x y) x 'a)\n", []string{
+			"1:1 this lambda takes 2 arguments, but is given 1",
+		}},
+		{"let arguments", "let (h x) x (h 'a 'b)\n", []string{
+			"1:14 h takes 1 argument, but is given 2",
+		}},
+		{"unbound", "car zz\n", []string{
+			"1:5 zz is never defined or bound, so it evaluates to itself",
+		}},
+		{"bound by a caller", "define (f x) y\ndefine (g y) (f 'a)\n(g 'b)\n", nil},
+		{"definition in try", "define k 'a\ntry no-time-limit 'car k nil\n", []string{
+			"2:24 k is defined, but try and eval do not see definitions, so here it evaluates to itself",
+		}},
+		{"unused", "define (f x) cons x nil\ndefine (g) (f 'a)\n", []string{
+			"2:9 g is defined but never used",
+		}},
+		{"list parameter", "define (f (x)) nil\n(f 'a)\n", []string{
+			"1:1 parameter (x) is a list, so it binds nothing",
+		}},
+		{"shadowed built-in", "define (f \"car) \"car\n(f 'a)\n", []string{
+			"1:12 parameter car shadows the built-in car",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := ReadProgram([]byte(tt.src))
+			if p.Err != nil {
+				t.Fatal(p.Err)
+			}
+			var got []string
+			for _, f := range Lint(p) {
+				line, col := sourcePos(p.M.Source, f.Off)
+				got = append(got, fmt.Sprintf("%d:%d %s", line, col, f.Msg))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findings = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileLine(t *testing.T) {
+	files := []inputFile{{"a.l", 1}, {"b.l", 4}, {"<stdin>", 10}}
+	tests := []struct {
+		line     int
+		name     string
+		fileLine int
+	}{
+		{1, "a.l", 1},
+		{3, "a.l", 3},
+		{4, "b.l", 1},
+		{9, "b.l", 6},
+		{12, "<stdin>", 3},
+	}
+	for _, tt := range tests {
+		if name, line := fileLine(files, tt.line); name != tt.name || line != tt.fileLine {
+			t.Errorf("fileLine(%d) = %s:%d, want %s:%d", tt.line, name, line, tt.name, tt.fileLine)
+		}
+	}
+}
@@ -2,10 +2,21 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"math/big"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 // --- Constants ---
@@ -21,6 +32,15 @@ const (
 	KindAtom
 )
 
+// Label styles for Print.
+const (
+	LabelPadded = iota // "value       (a b)", as in the .r transcripts
+	LabelColon         // "value: (a b)"
+	LabelNone          // "(a b)"
+)
+
+var labelStyles = map[string]int{"padded": LabelPadded, "colon": LabelColon, "none": LabelNone}
+
 const (
 	PrimNone = iota
 	PrimCar
@@ -69,6 +89,7 @@ type Machine struct {
 	LeftBracket, RightBracket, LeftParen, RightParen, DoubleQuote            int
 	SymZero, SymOne                                                          int
 	SymReadExp, SymUtm                                                       int
+	SymArity, SymDoc, SymTrace, SymUntrace, SymBreak, SymUnbreak, SymHeap    int
 
 	Primitives [PrimReadExp + 1]PrimitiveFunc
 
@@ -81,21 +102,107 @@ type Machine struct {
 	Q                int
 	Buffer2          int
 	InWordBuffer     int
+	Builtins         int
+
+	// Source holds the input read by InWord2, and WordPos and WordEnd give
+	// the span in Source of the word it returned last. lineSpans and
+	// wordSpans hold the spans of the words tokenized from the current line.
+	Source           []byte
+	WordPos, WordEnd int
+	lineSpans        []int
+	wordSpans        []int
+
+	// Positions, when not nil, maps each list Read returns or reads inside
+	// a top-level form to the offset in Source of its first word. newlines
+	// holds the offsets of the newlines in Source up to scanned.
+	Positions     map[int]int
+	readingSource bool
+	newlines      []int
+	scanned       int
+
+	// formHead is set while the reader has yet to take the first word of
+	// a top-level form, the only place a command is recognized, and
+	// formCommand once it has recognized one there.
+	formHead    bool
+	formCommand bool
+
+	// Comments holds the comments read since the current top-level form
+	// began; docs maps defined symbols to the comment that documents them.
+	Comments     []Comment
+	commentDepth int
+	commentStart int
+	formStart    int
+	lastFormEnd  int
+	formEnd      int
+	docs         map[int]string
+
+	// Out writes the transcript; form collects the results of the
+	// top-level form being evaluated, and TryDepth counts the try calls
+	// being evaluated.
+	Out      Output
+	form     *Form
+	TryDepth int
+
+	// TimeLimit is the time limit top-level expressions are evaluated with,
+	// like the first argument of try, or 0 for no-time-limit.
+	TimeLimit int
+
+	// MultiLineReadExp makes read-exp keep reading records from the tape
+	// until the S-expression is complete, and keep any words left over for
+	// the next read-exp on the same tape. By default read-exp reads exactly
+	// one record, as in the original interpreter.
+	MultiLineReadExp bool
+
+	// Output layout: Print wraps values after Width characters, or never
+	// if Width is 0, and writes labels in LabelStyle, padded to LabelWidth.
+	Width      int
+	LabelWidth int
+	LabelStyle int
+	indent     int
 
 	Reader *bufio.Reader
 	Writer io.Writer
+	// ErrWriter receives what is written apart from the transcript, such
+	// as backtraces. It discards it unless set.
+	ErrWriter io.Writer
+
+	interrupted atomic.Bool
+
+	// Stack holds the applications of lambdas in progress, innermost last.
+	// With Backtraces set, failure holds the frames a failure happened in
+	// until try catches it, and the backtrace is written to standard error.
+	Stack      []Frame
+	Backtraces bool
+	failure    []Frame
+
+	// hooks are told about the steps of Eval; EvalDepth counts the calls
+	// of Eval in progress while there are hooks.
+	hooks     []EvalHook
+	EvalDepth int
+	tracer    *Tracer
+	debugger  *Debugger
+	profiler  *Profiler
+	coverage  *Coverage
+	stepper   *Stepper
+	editor    *LineEditor // of the REPL, or of the debugger prompt
 }
 
 func NewMachine(r io.Reader, w io.Writer) *Machine {
-	return &Machine{
+	m := &Machine{
 		Nodes:        make([]Node, Size),
 		NextFree:     0,
 		Col:          0,
 		TimeEval:     0,
 		Reader:       bufio.NewReader(r),
 		Writer:       w,
+		ErrWriter:    io.Discard,
 		InWordBuffer: Nil,
+		Width:        50,
+		LabelWidth:   12,
+		LabelStyle:   LabelPadded,
 	}
+	m.Out = &classicOutput{m}
+	return m
 }
 
 // --- Initialization & Allocation ---
@@ -170,9 +277,83 @@ func (m *Machine) Init() {
 	m.SetCar(m.Value(m.SymNil), Nil)
 	m.SymZero = m.MkNum(big.NewInt(0))
 	m.SymOne = m.MkNum(big.NewInt(1))
+	m.Builtins = m.NextFree
 	m.setupPrimitives()
 }
 
+// commands lists the top-level forms that are not part of Chaitin's
+// interpreter, with the number of words each reads. They are interned by
+// LookupWord on first use rather than by Init, so that programs which never
+// mention them keep the exact cons counts of the original transcripts. A
+// command is only recognized as the first word of a top-level form;
+// anywhere else its name is an ordinary symbol.
+func (m *Machine) commands() []struct {
+	name string
+	args int
+	ptr  *int
+} {
+	return []struct {
+		name string
+		args int
+		ptr  *int
+	}{
+		{"arity", 3, &m.SymArity},
+		{"doc", 2, &m.SymDoc},
+		{"trace", 2, &m.SymTrace},
+		{"untrace", 2, &m.SymUntrace},
+		{"break", 2, &m.SymBreak},
+		{"unbreak", 2, &m.SymUnbreak},
+		{"heap", 2, &m.SymHeap},
+	}
+}
+
+func (m *Machine) internCommand(a int) {
+	name := m.NameString(a)
+	for _, c := range m.commands() {
+		if c.name == name {
+			*c.ptr = a
+			return
+		}
+	}
+}
+
+// commandArgs returns the number of words the command a reads, counting
+// itself.
+func (m *Machine) commandArgs(a int) int {
+	for _, c := range m.commands() {
+		if *c.ptr == a {
+			return c.args
+		}
+	}
+	return 0
+}
+
+// IsCommand reports whether atom a is one of the top-level commands, whose
+// first argument the reader takes literally.
+func (m *Machine) IsCommand(a int) bool {
+	for _, c := range m.commands() {
+		if *c.ptr != Nil && *c.ptr == a {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBuiltin reports whether the reader arity of atom a is fixed by the
+// interpreter: everything created by Init and the top-level commands.
+func (m *Machine) IsBuiltin(a int) bool {
+	if a < m.Builtins {
+		return true
+	}
+	name := m.NameString(a)
+	for _, c := range m.commands() {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Machine) prim1(f func(int) int) PrimitiveFunc {
 	return func(args int) int { return f(m.Car(args)) }
 }
@@ -188,9 +369,9 @@ func (m *Machine) setupPrimitives() {
 	m.Primitives[PrimAtom] = func(args int) int { return m.boolToSym(m.IsAtom(m.Car(args))) }
 	m.Primitives[PrimEq] = func(args int) int { return m.boolToSym(m.Eq(m.Car(args), m.Car(m.Cdr(args)))) }
 	m.Primitives[PrimDisplay] = func(args int) int {
-		x := m.Car(args)
+		x := m.Emit("display", m.Car(args))
 		if m.Car(m.DisplayEnabled) != 0 {
-			return m.Print("display", x)
+			return x
 		}
 		stubIdx := m.Car(m.CapturedDisplays)
 		oldEnd := m.Car(stubIdx)
@@ -199,7 +380,7 @@ func (m *Machine) setupPrimitives() {
 		m.SetCar(stubIdx, newEnd)
 		return x
 	}
-	m.Primitives[PrimDebug] = func(args int) int { return m.Print("debug", m.Car(args)) }
+	m.Primitives[PrimDebug] = func(args int) int { return m.Emit("debug", m.Car(args)) }
 	m.Primitives[PrimAppend] = func(args int) int {
 		x, y := m.Car(args), m.Car(m.Cdr(args))
 		pX, pY := x, y
@@ -254,6 +435,9 @@ func (m *Machine) setupPrimitives() {
 		return m.Cdr(v)
 	}
 	m.Primitives[PrimReadExp] = func(args int) int {
+		if m.MultiLineReadExp {
+			return m.readFrom(m.ReadWordMultiLine, false, false)
+		}
 		v := m.ReadRecord()
 		if v < 0 {
 			return v
@@ -263,9 +447,8 @@ func (m *Machine) setupPrimitives() {
 }
 
 func (m *Machine) alloc() int {
-	if m.NextFree >= Size {
-		fmt.Fprintf(m.Writer, "Storage overflow!\n")
-		os.Exit(0)
+	if m.NextFree >= len(m.Nodes) {
+		panic(errStorageOverflow)
 	}
 	a := m.NextFree
 	m.NextFree++
@@ -420,6 +603,12 @@ func (m *Machine) PrimCode(x int) int {
 	return PrimNone
 }
 
+func (m *Machine) NameString(x int) string {
+	var b []byte
+	m.serializeName(m.Name(x), func(c int) { b = append(b, byte(c)) })
+	return string(b)
+}
+
 func (m *Machine) PrimArgs(x int) int {
 	if m.Nodes[x].Kind == KindAtom {
 		return m.Nodes[x].Args
@@ -438,13 +627,45 @@ func (m *Machine) IsNumber(x int) bool {
 // --- Output ---
 
 func (m *Machine) Print(label string, x int) int {
-	fmt.Fprintf(m.Writer, "%-12s", label)
+	m.PrintLabel(label)
 	m.Col = 0
 	m.PrintList(x)
 	fmt.Fprintf(m.Writer, "\n")
 	return x
 }
 
+// PrintLabel starts a line of output with label in the current LabelStyle,
+// and sets the indentation of the lines that continue it.
+func (m *Machine) PrintLabel(label string) {
+	switch m.LabelStyle {
+	case LabelColon:
+		fmt.Fprintf(m.Writer, "%s: ", label)
+		m.indent = len(label) + 2
+	case LabelNone:
+		m.indent = 0
+	default:
+		fmt.Fprintf(m.Writer, "%-*s", m.LabelWidth, label)
+		m.indent = max(m.LabelWidth, len(label))
+	}
+}
+
+// PrintContinuation starts a line that continues the one PrintLabel began.
+func (m *Machine) PrintContinuation() {
+	fmt.Fprintf(m.Writer, "\n%*s", m.indent, "")
+}
+
+// PrintText prints lines of text after label, like a wrapped value.
+func (m *Machine) PrintText(label, text string) {
+	m.PrintLabel(label)
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			m.PrintContinuation()
+		}
+		fmt.Fprint(m.Writer, line)
+	}
+	fmt.Fprintln(m.Writer)
+}
+
 func (m *Machine) serialize(x int, out func(int)) {
 	if m.IsNumber(x) {
 		val := m.ToBigInt(x)
@@ -490,13 +711,24 @@ func (m *Machine) WriteLisp(x int) {
 }
 
 func (m *Machine) PrintChar(x int) {
-	if m.Col == 50 {
-		fmt.Fprintf(m.Writer, "\n%-12s", " ")
+	// UTF-8 continuation bytes share the column of their lead byte, so a
+	// multi-byte character is never split across lines.
+	if isContinuation(x) {
+		m.PutByte(x)
+		return
+	}
+	if m.Width > 0 && m.Col == m.Width {
+		m.PrintContinuation()
 		m.Col = 1
 	} else {
 		m.Col++
 	}
-	fmt.Fprintf(m.Writer, "%c", x)
+	m.PutByte(x)
+}
+
+// PutByte writes x to the output as a single raw byte.
+func (m *Machine) PutByte(x int) {
+	m.Writer.Write([]byte{byte(x)})
 }
 
 // --- Utils ---
@@ -528,6 +760,7 @@ func (m *Machine) LookupWord(x int) int {
 	}
 	i = m.MkAtom(PrimNone, "", 0)
 	m.SetName(i, x)
+	m.internCommand(i)
 	return i
 }
 
@@ -535,17 +768,61 @@ func (m *Machine) LookupWord(x int) int {
 
 func (m *Machine) GetChar() int {
 	b, err := m.Reader.ReadByte()
+	if m.interrupted.Load() {
+		panic(errInterrupted)
+	}
 	if err != nil {
-		fmt.Fprintf(m.Writer, "End of LISP Run\n\nCalls to eval = %d\nCalls to cons = %d\n", m.TimeEval, m.NextFree)
-		os.Exit(0)
+		panic(errEndOfInput)
+	}
+	// A CRLF line ending reads as a single '\n', so a file edited on another
+	// system gives the same echo and cons counts as the original.
+	if b == '\r' {
+		if next, err := m.Reader.Peek(1); err == nil && next[0] == '\n' {
+			b, _ = m.Reader.ReadByte()
+		}
 	}
 	return int(b)
 }
 
 // --- Parser ---
 
-func (m *Machine) isSeparator(character int, mexp bool) bool {
-	if character == ' ' || character == '\n' || character == '(' || character == ')' {
+// isSpace reports whether character is white space between tokens.
+func isSpace(character int) bool {
+	switch character {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+	return false
+}
+
+// isPrintable reports whether character is a printable ASCII character.
+func isPrintable(character int) bool {
+	return 32 < character && character < 127
+}
+
+// utf8Bytes marks the bytes of text that belong to a well-formed multi-byte
+// UTF-8 character. Atom names keep these bytes unchanged; a stray byte of 128
+// or more, like any other unprintable character, is dropped.
+func utf8Bytes(text []byte) []bool {
+	marks := make([]bool, len(text))
+	for i := 0; i < len(text); {
+		r, n := utf8.DecodeRune(text[i:])
+		if r != utf8.RuneError && n > 1 {
+			for j := i; j < i+n; j++ {
+				marks[j] = true
+			}
+		}
+		i += n
+	}
+	return marks
+}
+
+func isContinuation(character int) bool {
+	return character&0xC0 == 0x80
+}
+
+func isSeparator(character int, mexp bool) bool {
+	if isSpace(character) || character == '(' || character == ')' {
 		return true
 	}
 	if mexp {
@@ -557,6 +834,7 @@ func (m *Machine) isSeparator(character int, mexp bool) bool {
 func (m *Machine) tokenizeLine(getChar func() int, mexp bool) int {
 	line := m.List(Nil)
 	endOfLine := line
+	var text []byte
 	for {
 		character := getChar()
 		if character < 0 {
@@ -565,37 +843,47 @@ func (m *Machine) tokenizeLine(getChar func() int, mexp bool) int {
 		newNode := m.List(character)
 		m.SetCdr(endOfLine, newNode)
 		endOfLine = newNode
+		text = append(text, byte(character))
 		if character == '\n' {
 			break
 		}
 	}
 	line = m.Cdr(line)
+	multiByte := utf8Bytes(text)
 
 	tokens := m.List(Nil)
 	endOfTokens := tokens
 	word := Nil
+	spans := m.lineSpans[:0]
+	wordStart := 0
 
-	for line != Nil {
+	for i := 0; line != Nil; i++ {
 		character := m.Car(line)
 		line = m.Cdr(line)
-		if m.isSeparator(character, mexp) {
+		if isSeparator(character, mexp) {
 			if word != Nil {
 				newNode := m.List(word)
 				m.SetCdr(endOfTokens, newNode)
 				endOfTokens = newNode
+				spans = append(spans, wordStart, i)
 			}
 			word = Nil
-			if character != ' ' && character != '\n' {
+			if !isSpace(character) {
 				newNode := m.List(m.List(character))
 				m.SetCdr(endOfTokens, newNode)
 				endOfTokens = newNode
+				spans = append(spans, i, i+1)
 			}
 		} else {
-			if 32 < character && character < 127 {
+			if isPrintable(character) || multiByte[i] {
+				if word == Nil {
+					wordStart = i
+				}
 				word = m.Cons(character, word)
 			}
 		}
 	}
+	m.lineSpans = spans
 	return m.Cdr(tokens)
 }
 
@@ -608,14 +896,22 @@ func (m *Machine) tokenToExpr(token int) int {
 
 func (m *Machine) InWord2() int {
 	for m.InWordBuffer == Nil {
+		lineStart := len(m.Source)
 		m.InWordBuffer = m.tokenizeLine(func() int {
 			character := m.GetChar()
-			fmt.Fprintf(m.Writer, "%c", character)
+			m.Out.Echo(character)
+			m.Source = append(m.Source, byte(character))
 			return character
 		}, true)
+		m.wordSpans = m.wordSpans[:0]
+		for _, pos := range m.lineSpans {
+			m.wordSpans = append(m.wordSpans, lineStart+pos)
+		}
 	}
 	word := m.Car(m.InWordBuffer)
 	m.InWordBuffer = m.Cdr(m.InWordBuffer)
+	m.WordPos, m.WordEnd = m.wordSpans[0], m.wordSpans[1]
+	m.wordSpans = m.wordSpans[2:]
 	return m.tokenToExpr(word)
 }
 
@@ -635,10 +931,22 @@ func (m *Machine) InWord() int {
 	for {
 		w = m.InWord2()
 		if w != m.LeftBracket {
+			if m.commentDepth == 0 {
+				m.wordRead()
+			}
 			return w
 		}
+		start := m.WordPos
+		if m.commentDepth == 0 {
+			m.commentStart = start
+		}
+		m.commentDepth++
 		for m.InWord() != m.RightBracket {
 		}
+		m.commentDepth--
+		if m.commentDepth == 0 {
+			m.addComment(start, m.WordEnd)
+		}
 	}
 }
 
@@ -647,7 +955,10 @@ func (m *Machine) readList(wordSource func() int, mexp bool) int {
 	last := first
 	for {
 		next := m.readFrom(wordSource, mexp, true)
-		if next == m.RightParen || next < 0 {
+		if next < 0 {
+			return next
+		}
+		if next == m.RightParen {
 			break
 		}
 		newNode := m.List(next)
@@ -658,12 +969,31 @@ func (m *Machine) readList(wordSource func() int, mexp bool) int {
 }
 
 func (m *Machine) Read(mexp bool, rparenokay bool) int {
+	if m.Positions != nil {
+		m.readingSource = true
+		defer func() { m.readingSource = false }()
+	}
+	m.formHead, m.formCommand = true, false
 	return m.readFrom(m.InWord, mexp, rparenokay)
 }
 
-func (m *Machine) readFrom(wordSource func() int, mexp bool, rparenokay bool) int {
+func (m *Machine) readFrom(wordSource func() int, mexp bool, rparenokay bool) (e int) {
 	var w, name, def, body, varLst, i int
+	// A negative word is a failure such as out-of-data from the tape; it is
+	// passed up unchanged, like a failure in Eval.
 	w = wordSource()
+	head := m.formHead
+	m.formHead = false
+	if w < 0 {
+		return w
+	}
+	if m.readingSource {
+		defer func(pos int) {
+			if e >= 0 && !m.IsAtom(e) {
+				m.Positions[e] = pos
+			}
+		}(m.WordPos)
+	}
 	if w == m.RightParen {
 		if rparenokay {
 			return w
@@ -681,22 +1011,62 @@ func (m *Machine) readFrom(wordSource func() int, mexp bool, rparenokay bool) in
 	}
 	if w == m.SymCadr {
 		sexp := m.readFrom(wordSource, true, false)
+		if sexp < 0 {
+			return sexp
+		}
 		return m.List(m.SymCar, m.List(m.SymCdr, sexp))
 	}
 	if w == m.SymCaddr {
 		sexp := m.readFrom(wordSource, true, false)
+		if sexp < 0 {
+			return sexp
+		}
 		return m.List(m.SymCar, m.List(m.SymCdr, m.List(m.SymCdr, sexp)))
 	}
 	if w == m.SymUtm {
 		sexp := m.readFrom(wordSource, true, false)
+		if sexp < 0 {
+			return sexp
+		}
 		inner := m.List(m.SymQuote, m.List(m.SymEval, m.List(m.SymReadExp)))
 		try_ := m.List(m.SymTry, m.SymNoTimeLimit, inner, sexp)
 		return m.List(m.SymCar, m.List(m.SymCdr, try_))
 	}
+	if head && m.IsCommand(w) {
+		m.formCommand = true
+		// The symbol a command is about is read literally, so that, for
+		// example, an arity declaration can be changed after it has taken
+		// effect.
+		name = m.readFrom(wordSource, false, false)
+		if name < 0 {
+			return name
+		}
+		first := m.List(w, name)
+		last := m.Cdr(first)
+		for i = m.commandArgs(w) - 2; i > 0; i-- {
+			arg := m.readFrom(wordSource, true, false)
+			if arg < 0 {
+				return arg
+			}
+			newNode := m.List(arg)
+			m.SetCdr(last, newNode)
+			last = newNode
+		}
+		return first
+	}
 	if w == m.SymLet {
 		name = m.readFrom(wordSource, true, false)
+		if name < 0 {
+			return name
+		}
 		def = m.readFrom(wordSource, true, false)
+		if def < 0 {
+			return def
+		}
 		body = m.readFrom(wordSource, true, false)
+		if body < 0 {
+			return body
+		}
 		if !m.IsAtom(name) {
 			varLst = m.Cdr(name)
 			name = m.Car(name)
@@ -712,7 +1082,11 @@ func (m *Machine) readFrom(wordSource func() int, mexp bool, rparenokay bool) in
 	last := first
 	i--
 	for i > 0 {
-		newNode := m.List(m.readFrom(wordSource, true, false))
+		arg := m.readFrom(wordSource, true, false)
+		if arg < 0 {
+			return arg
+		}
+		newNode := m.List(arg)
 		m.SetCdr(last, newNode)
 		last = newNode
 		i--
@@ -720,23 +1094,75 @@ func (m *Machine) readFrom(wordSource func() int, mexp bool, rparenokay bool) in
 	return first
 }
 
+// DeclareArity gives the user symbol name an M-expression reader arity of n
+// arguments, so that "f a b" reads as (f a b) once f has arity 2. A number n
+// sets the arity (0 means a call with no arguments, like read-bit); anything
+// else removes the declaration. Built-in symbols are left unchanged.
+func (m *Machine) DeclareArity(name, n int) int {
+	if !m.IsAtom(name) || m.IsNumber(name) || m.IsBuiltin(name) {
+		return name
+	}
+	m.Nodes[name].Args = 0
+	if m.IsNumber(n) && m.ToBigInt(n).IsInt64() {
+		m.Nodes[name].Args = int(m.ToBigInt(n).Int64()) + 1
+	}
+	return name
+}
+
+// Arity returns the number of arguments the reader collects after atom x,
+// or nil when x is read as a plain atom.
+func (m *Machine) Arity(x int) int {
+	if m.PrimArgs(x) == 0 {
+		return Nil
+	}
+	return m.MkNum(big.NewInt(int64(m.PrimArgs(x) - 1)))
+}
+
 // --- Evaluator ---
 
 func (m *Machine) Ev(e int) int {
 	m.Tapes = m.List(Nil)
 	m.DisplayEnabled = m.List(1)
 	m.CapturedDisplays = m.List(Nil)
-	v := m.Eval(e, m.SymNoTimeLimit)
+	m.EvalDepth = 0
+	m.Stack, m.failure = m.Stack[:0], nil
+	d := m.SymNoTimeLimit
+	if m.TimeLimit > 0 {
+		d = m.MkNum(big.NewInt(int64(m.TimeLimit)))
+	}
+	v := m.Eval(e, d)
 	if v < 0 {
+		m.reportFailure(v, 0)
 		return -v
 	}
 	return v
 }
 
+// Eval evaluates e with time limit d. The hooks of the machine, if any, are
+// told when it starts and what it returns.
 func (m *Machine) Eval(e, d int) int {
-	var f, v, args, x, y, z int
+	if len(m.hooks) == 0 {
+		return m.eval(e, d)
+	}
+	m.EvalDepth++
+	for _, h := range m.hooks {
+		h.Enter(e)
+	}
+	v := m.eval(e, d)
+	m.EvalDepth--
+	for _, h := range m.hooks {
+		h.Leave(e, v)
+	}
+	return v
+}
+
+func (m *Machine) eval(e, d int) int {
+	var f, v, args int
 
 	m.TimeEval++
+	if m.interrupted.Load() {
+		panic(errInterrupted)
+	}
 
 	if m.IsNumber(e) {
 		return e
@@ -748,7 +1174,8 @@ func (m *Machine) Eval(e, d int) int {
 		return e
 	}
 
-	f = m.Eval(m.Car(e), d)
+	expr, head := e, m.Car(e)
+	f = m.Eval(head, d)
 	e = m.Cdr(e)
 	if f < 0 {
 		return f
@@ -764,6 +1191,9 @@ func (m *Machine) Eval(e, d int) int {
 		if v < 0 {
 			return v
 		}
+		for _, h := range m.hooks {
+			h.Branch(expr, v != m.SymFalse)
+		}
 		if v == m.SymFalse {
 			e = m.Cdr(e)
 		}
@@ -774,6 +1204,39 @@ func (m *Machine) Eval(e, d int) int {
 	if args < 0 {
 		return args
 	}
+	// Only lambdas have frames; without hooks a primitive is applied
+	// directly.
+	if len(m.hooks) == 0 && m.IsAtom(f) {
+		return m.apply(f, args, d)
+	}
+	name := Nil
+	if m.IsAtom(head) {
+		name = head
+	}
+	lambda := !m.IsAtom(f) && m.Car(f) == m.SymLambda
+	if lambda {
+		m.Stack = append(m.Stack, Frame{name, f, args, m.EvalDepth})
+	}
+	for _, h := range m.hooks {
+		h.Apply(f, name, args)
+	}
+	v = m.apply(f, args, d)
+	for _, h := range m.hooks {
+		h.Return(f, name, args, v)
+	}
+	if lambda {
+		if v < 0 {
+			m.noteFailure()
+		}
+		m.Stack = m.Stack[:len(m.Stack)-1]
+	}
+	return v
+}
+
+// apply applies the value f of the head of an expression to the evaluated
+// arguments args, with time limit d.
+func (m *Machine) apply(f, args, d int) int {
+	var v, x, y, z int
 
 	x = m.Car(args)
 	y = m.Car(m.Cdr(args))
@@ -809,14 +1272,19 @@ func (m *Machine) Eval(e, d int) int {
 			x = d
 		}
 		m.Tapes = m.Cons(z, m.Tapes)
+		words := m.Buffer2
+		m.Buffer2 = Nil
 		m.DisplayEnabled = m.Cons(0, m.DisplayEnabled)
 		stub = m.List(0)
 		m.SetCar(stub, stub)
 		m.CapturedDisplays = m.Cons(stub, m.CapturedDisplays)
 		m.CleanEnv()
+		m.TryDepth++
 		v = m.Eval(y, x)
+		m.TryDepth--
 		m.RestoreEnv()
 		m.Tapes = m.Cdr(m.Tapes)
+		m.Buffer2 = words
 		m.DisplayEnabled = m.Cdr(m.DisplayEnabled)
 		stubIdx := m.Car(m.CapturedDisplays)
 		m.CapturedDisplays = m.Cdr(m.CapturedDisplays)
@@ -826,6 +1294,7 @@ func (m *Machine) Eval(e, d int) int {
 			return v
 		}
 		if v < 0 {
+			m.reportFailure(v, m.TryDepth+1)
 			return m.List(m.SymFailure, -v, stub)
 		}
 		return m.List(m.SymSuccess, v, stub)
@@ -1098,46 +1567,488 @@ func (m *Machine) ReadWord() int {
 	return m.tokenToExpr(word)
 }
 
+// ReadWordMultiLine is ReadWord for MultiLineReadExp: when the current record
+// runs out it reads the next one instead of closing the expression.
+func (m *Machine) ReadWordMultiLine() int {
+	for m.Buffer2 == Nil {
+		if v := m.ReadRecord(); v < 0 {
+			return v
+		}
+	}
+	return m.ReadWord()
+}
+
 func (m *Machine) ReadExpr(rparen bool) int {
 	return m.readFrom(m.ReadWord, false, rparen)
 }
 
-func (m *Machine) Run() {
-	fmt.Fprintf(m.Writer, "LISP Interpreter Run\n")
+// These errors end a run: GetChar panics with errEndOfInput at the end of
+// the input, alloc with errStorageOverflow when Nodes is full, and Eval and
+// GetChar with errInterrupted after Interrupt. Run recovers them.
+var (
+	errEndOfInput      = errors.New("end of input")
+	errStorageOverflow = errors.New("storage overflow")
+	errInterrupted     = errors.New("interrupted")
+)
+
+// Interrupt makes the machine stop at the next call of Eval or GetChar. It
+// may be called from another goroutine.
+func (m *Machine) Interrupt() {
+	m.interrupted.Store(true)
+}
+
+// Run starts the transcript, initializes the machine, and reads and
+// evaluates top-level forms until the end of the input. It returns
+// errStorageOverflow if the machine ran out of nodes, errInterrupted if it
+// was interrupted, and a SyntaxError if the input ends inside a form.
+func (m *Machine) Run() error {
+	m.Out.Start()
+	if err := m.initRun(); err != nil {
+		return err
+	}
+	return m.Continue()
+}
+
+// initRun runs Init, which overflows a heap too small for the built-in
+// atoms.
+func (m *Machine) initRun() (err error) {
+	defer m.endRun(&err)
 	m.Init()
+	return nil
+}
+
+// endRun recovers the errors that end a run, ends the transcript and sets
+// *err. It is deferred by the functions that run the machine.
+func (m *Machine) endRun(err *error) {
+	switch r := recover(); r {
+	case nil:
+	case errEndOfInput:
+		m.Out.End(&Summary{m.TimeEval, m.NextFree, false})
+		*err = m.incompleteForm()
+	case errStorageOverflow, errInterrupted:
+		*err = r.(error)
+		if *err == errStorageOverflow {
+			m.Out.End(&Summary{m.TimeEval, m.NextFree, true})
+		}
+		if len(m.Stack) > 0 {
+			fmt.Fprintf(m.ErrWriter, "backtrace of %v:\n", *err)
+			m.WriteBacktrace(m.ErrWriter, "", m.Stack)
+		}
+	default:
+		panic(r)
+	}
+}
+
+// Continue reads and evaluates top-level forms from Reader until the end of
+// the input, keeping the definitions made so far.
+func (m *Machine) Continue() (err error) {
+	defer m.endRun(&err)
 
 	for {
-		fmt.Fprintf(m.Writer, "\n")
+		m.Out.BeginForm()
+		m.beginForm()
+		evals, conses := m.TimeEval, m.NextFree
 		e := m.Read(true, false)
-		fmt.Fprintf(m.Writer, "\n")
-
-		f := m.Car(e)
-		if f == m.SymDefine {
-			args := m.Cdr(e)
-			name := m.Car(args)
-			def := m.Car(m.Cdr(args))
-
-			if !m.IsAtom(name) {
-				varList := m.Cdr(name)
-				sName := m.Car(name)
-				newDef := m.List(m.SymLambda, varList, def)
-				m.Print("define", sName)
-				m.Print("value", newDef)
-				// define was setting the Value of the symbol.
-				m.SetCar(m.Value(sName), newDef)
-			} else {
-				m.Print("define", name)
-				m.Print("value", def)
-				m.SetCar(m.Value(name), def)
-			}
-			continue
+		// The time is that of the evaluation, not of waiting for input.
+		start := time.Now()
+		m.Out.Read()
+		if m.coverage != nil {
+			m.coverage.addForm(e)
+		}
+
+		m.form = &Form{Source: string(m.Source[m.formStart:m.formEnd]), Expr: e, Value: Nil, Name: Nil}
+		m.topLevel(e)
+		m.form.Evals = m.TimeEval - evals
+		m.form.Conses = m.NextFree - conses
+		m.form.Time = time.Since(start)
+		m.Out.EndForm(m.form)
+		m.form = nil
+	}
+}
+
+// topLevel evaluates the top-level form e and records its results.
+func (m *Machine) topLevel(e int) {
+	f := m.Car(e)
+	// A command is a form the reader read as one; a list that starts with
+	// the name of a command, such as (doc x), is an expression.
+	cmd := Nil
+	if m.formCommand {
+		cmd = f
+	}
+	if cmd != Nil && cmd == m.SymArity {
+		args := m.Cdr(e)
+		m.form.Name = m.DeclareArity(m.Car(args), m.Car(m.Cdr(args)))
+		m.form.Value = m.Arity(m.Car(args))
+		m.Out.Record("arity", m.form.Name)
+		m.Out.Record("value", m.form.Value)
+		return
+	}
+	if cmd != Nil && cmd == m.SymDoc {
+		m.form.Name = m.Car(m.Cdr(e))
+		m.PrintDoc(m.form.Name)
+		return
+	}
+	if cmd != Nil && (cmd == m.SymTrace || cmd == m.SymUntrace) {
+		m.form.Name = m.Car(m.Cdr(e))
+		m.form.Value = m.form.Name
+		m.Trace(m.form.Name, cmd == m.SymTrace)
+		m.Out.Record(m.NameString(cmd), m.form.Name)
+		return
+	}
+	if cmd != Nil && (cmd == m.SymBreak || cmd == m.SymUnbreak) {
+		m.form.Name = m.Car(m.Cdr(e))
+		m.form.Value = m.form.Name
+		m.Break(m.form.Name, cmd == m.SymBreak)
+		m.Out.Record(m.NameString(cmd), m.form.Name)
+		return
+	}
+	if cmd != Nil && cmd == m.SymHeap {
+		m.form.Name = m.Car(m.Cdr(e))
+		m.heapCommand(m.form.Name)
+		return
+	}
+	if f == m.SymDefine {
+		args := m.Cdr(e)
+		name := m.Car(args)
+		def := m.Car(m.Cdr(args))
+
+		if !m.IsAtom(name) {
+			varList := m.Cdr(name)
+			name = m.Car(name)
+			def = m.List(m.SymLambda, varList, def)
 		}
-		m.Print("expression", e)
-		m.Print("value", m.Ev(e))
+		m.Out.Record("define", name)
+		m.Out.Record("value", def)
+		// define was setting the Value of the symbol.
+		m.SetCar(m.Value(name), def)
+		m.setDoc(name)
+		m.form.Define, m.form.Name, m.form.Value = true, name, def
+		return
+	}
+	m.Out.Record("expression", e)
+	m.form.Value = m.Ev(e)
+	m.Out.Record("value", m.form.Value)
+}
+
+// incompleteForm returns a SyntaxError if the input ended inside a
+// top-level form or a comment.
+func (m *Machine) incompleteForm() error {
+	switch {
+	case m.commentDepth > 0:
+		line, col := sourcePos(m.Source, m.commentStart)
+		return &SyntaxError{line, col, "comment is not closed"}
+	case m.formStart >= 0:
+		line, col := sourcePos(m.Source, m.formStart)
+		return &SyntaxError{line, col, "unexpected end of input in this form"}
 	}
+	return nil
+}
+
+// Emit reports a display or debug output of x.
+func (m *Machine) Emit(label string, x int) int {
+	e := Event{label, x, m.TryDepth}
+	if m.form != nil {
+		m.form.Events = append(m.form.Events, e)
+	}
+	m.Out.Event(e)
+	return x
+}
+
+// Exit statuses of the interpreter.
+const (
+	ExitSuccess     = 0
+	ExitSyntax      = 1 // a file ends inside a form or a comment
+	ExitUsage       = 2 // bad flags, or a file that cannot be read
+	ExitResources   = 3 // storage overflow
+	ExitInternal    = 4 // a bug in the interpreter
+	ExitFindings    = 5 // lint found problems
+	ExitInterrupted = 130
+)
+
+var exitStatusNames = map[int]string{
+	ExitSuccess:     "success",
+	ExitSyntax:      "syntax-error",
+	ExitUsage:       "usage",
+	ExitResources:   "storage-overflow",
+	ExitInternal:    "internal-error",
+	ExitFindings:    "findings",
+	ExitInterrupted: "interrupted",
+}
+
+// exitStatus runs f and returns the exit status for how it ended. It
+// reports errors on standard error, syntax errors at their line in files.
+func exitStatus(files []inputFile, f func() error) (status int) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "internal error: %v\n%s", r, debug.Stack())
+			status = ExitInternal
+		}
+	}()
+	var syntaxErr *SyntaxError
+	switch err := f(); {
+	case err == nil:
+		return ExitSuccess
+	case errors.As(err, &syntaxErr):
+		name, line := fileLine(files, syntaxErr.Line)
+		fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n", name, line, syntaxErr.Col, syntaxErr.Msg)
+		return ExitSyntax
+	case err == errStorageOverflow:
+		return ExitResources
+	case err == errInterrupted:
+		fmt.Fprintln(os.Stderr, "interrupted")
+		return ExitInterrupted
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		return ExitInternal
+	}
+}
+
+// handleInterrupts makes an interrupt signal stop m. A second one, for when
+// m is waiting for input, exits at once.
+func handleInterrupts(m *Machine) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		m.Interrupt()
+		<-c
+		os.Exit(ExitInterrupted)
+	}()
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		os.Exit(fmtMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		os.Exit(testMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		os.Exit(compareMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dap" {
+		os.Exit(dapMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lsp" {
+		os.Exit(lspMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		os.Exit(lintMain(os.Args[2:]))
+	}
+
+	multiLine := flag.Bool("multiline-read-exp", false, "read-exp reads tape records until the expression is complete")
+	width := flag.Int("width", 50, "wrap values after `n` characters")
+	noWrap := flag.Bool("nowrap", false, "never wrap values")
+	labels := flag.String("labels", "padded", "label style: padded, colon or none")
+	labelWidth := flag.Int("label-width", 12, "width of padded labels")
+	output := flag.String("output", "classic", "transcript format: classic, quiet, values, ndjson or html")
+	batch := flag.Bool("batch", false, "write a transcript even when the input is a terminal")
+	stats := flag.Bool("stats", false, "print the evals, conses and time of each top-level form")
+	statsSort := flag.String("stats-sort", "", "at the end, list the costliest forms by `key`: evals, conses, time or order")
+	statsTop := flag.Int("stats-top", 10, "list `n` forms at the end, or all if 0")
+	repl := flag.Bool("repl", false, "start the REPL after running the files")
+	timeLimit := flag.Int("time-limit", 0, "evaluate top-level expressions with time limit `n`, or no-time-limit if 0")
+	heap := flag.Int("heap", Size, "the number of `nodes` in the heap")
+	trace := flag.String("trace", "", "trace the functions with these comma-separated `names`, or all named functions for *")
+	breaks := flag.String("break", "", "start the debugger on entry to the functions or at the lines with these comma-separated `names`")
+	breakAt := flag.Int("break-at", 0, "start the debugger when the number of eval calls reaches `n`")
+	profile := flag.Bool("profile", false, "at the end, print the evals and conses of each function on stderr")
+	pprofFile := flag.String("pprof", "", "write a profile of the functions for go tool pprof to `file`")
+	cover := flag.Bool("cover", false, "at the end, print how much of the code of each define was evaluated on stderr")
+	coverListing := flag.String("cover-listing", "", "write the source annotated with what was evaluated to `file`")
+	heapReport := flag.Int("heap-report", 0, "write a summary of the heap to stderr every `n` calls of eval")
+	steps := flag.Int("steps", 0, "write the steps of the evaluation of the top-level expression on `line` to stderr")
+	stepsMax := flag.Int("steps-max", 1000, "record at most `n` steps")
+	stepsHTML := flag.String("steps-html", "", "write the steps as HTML to `file` instead")
+	backtraces := flag.Bool("backtrace", false, "print the applications in progress when try catches a failure")
+	summary := flag.String("summary", "stdout", "write the totals at the end of the transcript (stdout) or as a JSON line on stderr")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: lisp [flags] [file.l | - ...]\n       lisp fmt|test|compare|dap|lsp|lint [flags] ...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	m := NewMachine(os.Stdin, os.Stdout)
-	m.Run()
+	m.ErrWriter = os.Stderr
+	start := time.Now()
+	if *summary != "stdout" && *summary != "stderr" {
+		fmt.Fprintf(os.Stderr, "unknown summary destination %q\n", *summary)
+		os.Exit(ExitUsage)
+	}
+	var files []inputFile
+	if flag.NArg() > 0 {
+		var src []byte
+		var status int
+		src, files, status = readFiles(flag.Args())
+		if status != ExitSuccess {
+			if *summary == "stderr" {
+				writeSummary(m, status, start)
+			}
+			os.Exit(status)
+		}
+		m.Reader = bufio.NewReader(bytes.NewReader(src))
+	}
+	if *heap != Size {
+		m.Nodes = make([]Node, max(*heap, 1))
+	}
+	m.TimeLimit = *timeLimit
+	m.Backtraces = *backtraces
+	if *trace == "*" {
+		m.Tracer().All = true
+	} else if *trace != "" {
+		for _, name := range strings.Split(*trace, ",") {
+			m.Tracer().Names[name] = true
+		}
+	}
+	if *breaks != "" {
+		for _, name := range strings.Split(*breaks, ",") {
+			if n, err := strconv.Atoi(name); err == nil {
+				m.Debugger().Lines[n] = true
+			} else {
+				m.Debugger().Breaks[name] = true
+			}
+		}
+	}
+	if *breakAt > 0 {
+		m.Debugger().At = *breakAt
+	}
+	if *profile || *pprofFile != "" {
+		m.Profiler()
+	}
+	if *cover || *coverListing != "" {
+		m.Coverage()
+	}
+	if *heapReport > 0 {
+		m.ReportHeap(*heapReport)
+	}
+	if *steps > 0 {
+		m.Stepper().Line = *steps
+		m.Stepper().Max = *stepsMax
+	}
+	m.MultiLineReadExp = *multiLine
+	m.Width = *width
+	if *noWrap {
+		m.Width = 0
+	}
+	style, ok := labelStyles[*labels]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown label style %q\n", *labels)
+		os.Exit(ExitUsage)
+	}
+	m.LabelStyle = style
+	m.LabelWidth = *labelWidth
+	newOutput, ok := outputs[*output]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown output mode %q\n", *output)
+		os.Exit(ExitUsage)
+	}
+	m.Out = newOutput(m)
+	if h, ok := m.Out.(*htmlOutput); ok && flag.NArg() > 0 {
+		h.Title = strings.Join(flag.Args(), ", ")
+	}
+	if *summary == "stderr" {
+		m.Out = &noSummaryOutput{m.Out}
+	}
+	if *stats || *statsSort != "" {
+		if _, ok := statsKeys[*statsSort]; !ok && *statsSort != "" {
+			fmt.Fprintf(os.Stderr, "unknown sort key %q\n", *statsSort)
+			os.Exit(ExitUsage)
+		}
+		m.Out = &statsOutput{Output: m.Out, m: m, footer: *stats, sortBy: *statsSort, top: *statsTop, w: os.Stderr}
+	}
+	handleInterrupts(m)
+	var status int
+	if flag.NArg() == 0 && !*batch && *output == "classic" && IsTerminal(os.Stdin) {
+		status = exitStatus(nil, func() error { return m.RunREPL(os.Stdin, os.Stdout) })
+	} else {
+		status = exitStatus(files, m.Run)
+		if status == ExitSuccess && *repl {
+			status = exitStatus(nil, func() error { return m.RunREPL(os.Stdin, os.Stdout) })
+		}
+	}
+	if *profile {
+		m.Profiler().WriteReport(os.Stderr)
+	}
+	if *pprofFile != "" {
+		if err := writePprof(m, *pprofFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if *steps > 0 {
+		if err := writeSteps(m, *stepsHTML); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if *cover {
+		m.Coverage().WriteReport(os.Stderr)
+	}
+	if *coverListing != "" {
+		if err := writeCoverage(m, *coverListing); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if *summary == "stderr" {
+		writeSummary(m, status, start)
+	}
+	os.Exit(status)
+}
+
+// writeSummary writes the totals of the run of m as a JSON line on standard
+// error.
+func writeSummary(m *Machine, status int, start time.Time) {
+	json.NewEncoder(os.Stderr).Encode(runSummary{
+		Type:    "summary",
+		Status:  exitStatusNames[status],
+		Exit:    status,
+		Evals:   m.TimeEval,
+		Conses:  m.NextFree,
+		Seconds: time.Since(start).Seconds(),
+	})
+}
+
+// inputFile is a file of an input joined by readFiles, with the line of the
+// input it starts on.
+type inputFile struct {
+	name string
+	line int
+}
+
+// readFiles reads the named files, or standard input for "-", and joins
+// them into one input. It reports the files that cannot be read, or read to
+// the end, on standard error, and returns the exit status for them.
+func readFiles(names []string) ([]byte, []inputFile, int) {
+	var src []byte
+	var files []inputFile
+	line := 1
+	status := ExitSuccess
+	for _, name := range names {
+		var data []byte
+		var err error
+		if name == "-" {
+			name = "<stdin>"
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = ExitUsage
+			continue
+		}
+		if err = CheckSyntax(data); err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%v\n", name, err)
+			if status == ExitSuccess {
+				status = ExitSyntax
+			}
+			continue
+		}
+		files = append(files, inputFile{name, line})
+		src = append(src, data...)
+		line += bytes.Count(data, []byte("\n"))
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			src = append(src, '\n')
+			line++
+		}
+	}
+	return src, files, status
 }
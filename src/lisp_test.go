@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs main instead of the tests when LISP_MAIN_ARGS holds the
+// arguments of a run, so that runLisp can run the interpreter as a command.
+func TestMain(tm *testing.M) {
+	if encoded := os.Getenv("LISP_MAIN_ARGS"); encoded != "" {
+		var args []string
+		json.Unmarshal([]byte(encoded), &args)
+		os.Args = append([]string{"lisp"}, args...)
+		main()
+	}
+	os.Exit(tm.Run())
+}
+
+// runLisp runs the interpreter with args on the input stdin, and returns
+// its standard output and error and its exit status.
+func runLisp(t *testing.T, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	encoded, _ := json.Marshal(append([]string{}, args...))
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "LISP_MAIN_ARGS="+string(encoded))
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+// values returns the value records of the transcript tr.
+func values(tr string) []string {
+	var vs []string
+	for _, f := range ParseTranscript([]byte(tr)).Forms {
+		for _, r := range f.Records {
+			if r.Label == "value" {
+				vs = append(vs, r.Value)
+			}
+		}
+	}
+	return vs
+}
+
+func TestCharacters(t *testing.T) {
+	tests := []struct {
+		name, src string
+		values    []string
+	}{
+		{"tabs", "car\t'(a\tb)\n", []string{"a"}},
+		{"other white space", "car '(a\vb\fc)\n", []string{"a"}},
+		{"utf-8 name", "define λx 5\ncons λx '(λx)\n", []string{"5", "(5 λx)"}},
+		{"stray bytes", "'(a \x01b \xffc)\n", []string{"(a b c)"}},
+		// A character takes 8 bits per byte of its UTF-8 encoding,
+		// followed by those of a newline.
+		{"bits", "bits 'ë\n", []string{"(1 1 0 0 0 0 1 1 1 0 1 0 1 0 1 1 0 0 0 0 1 0 1 0)"}},
+		{"size", "size 'ë\n", []string{"2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := values(string(RunTranscript([]byte(tt.src)))); strings.Join(got, "\n") != strings.Join(tt.values, "\n") {
+				t.Errorf("values %q, want %q", got, tt.values)
+			}
+		})
+	}
+}
+
+// TestCRLF checks that a file with CRLF line ends gives the transcript,
+// and the cons counts, of the same file with newlines.
+func TestCRLF(t *testing.T) {
+	src := "[ a\ncomment ]\ndefine (f x)\n   cons x\n   nil\n(f 'ë)\ncar '(a\nb)\n"
+	want := RunTranscript([]byte(src))
+	got := RunTranscript([]byte(strings.ReplaceAll(src, "\n", "\r\n")))
+	if !bytes.Equal(got, want) {
+		t.Errorf("with CRLF:\n%s\nwith LF:\n%s", got, want)
+	}
+	if !bytes.Contains(want, []byte("value       (ë)")) {
+		t.Errorf("transcript %s has no value (ë)", want)
+	}
+}
+
+// tapeBits returns a quoted list of the bits of s, 8 to a byte, as read-bit
+// and read-exp read them.
+func tapeBits(s string) string {
+	var b strings.Builder
+	b.WriteString("'(")
+	for i := 0; i < len(s); i++ {
+		for j := 7; j >= 0; j-- {
+			b.WriteByte('0' + s[i]>>j&1)
+			b.WriteByte(' ')
+		}
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+func TestReadExpRecords(t *testing.T) {
+	const one, two = "(read-exp)", "(cons (read-exp) (cons (read-exp) nil))"
+	tests := []struct {
+		name, tape, expr string
+		multiLine        bool
+		value            string
+	}{
+		// By default read-exp reads one record and closes the lists still
+		// open at its end.
+		{"open lists closed", "((a\nb) c)\n", one, false, "(success ((a)) ())"},
+		{"rest of record", "((a) b\nc)\n", one, false, "(success ((a) b) ())"},
+		{"next record", "((a\nb) c)\n", two, false, "(success (((a)) b) ())"},
+		{"leftover words dropped", "a b\n", two, false, "(failure out-of-data ())"},
+		// With MultiLineReadExp it reads records until the expression is
+		// balanced.
+		{"multi-line", "((a\nb) c)\n", one, true, "(success ((a b) c) ())"},
+		{"multi-line rest", "((a) b\nc)\n", one, true, "(success ((a) b c) ())"},
+		{"leftover words kept", "a b\n", two, true, "(success (a b) ())"},
+		{"out of data", "((a\nb)\n", one, true, "(failure out-of-data ())"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			src := "try no-time-limit '" + tt.expr + " " + tapeBits(tt.tape) + "\n"
+			m := NewMachine(strings.NewReader(src), &out)
+			m.MultiLineReadExp = tt.multiLine
+			m.Run()
+			if got := values(out.String()); len(got) != 1 || got[0] != tt.value {
+				t.Errorf("value %q, want %q", got, tt.value)
+			}
+		})
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.l")
+	os.WriteFile(bad, []byte("car '(a)\ndefine (f x\n"), 0666)
+	loop := "define (f n) cons n (f n)\n(f 'a)\n"
+	tests := []struct {
+		name, stdin string
+		args        []string
+		status      int
+		totals      bool   // the transcript ends with the totals
+		stderr      string // the first line of standard error
+	}{
+		{"success", "car '(a)\n", nil, ExitSuccess, true, ""},
+		{"syntax error", "cons 'a\n", nil, ExitSyntax, true, "<input>:1:1: unexpected end of input in this form"},
+		{"syntax error in a file", "", []string{bad}, ExitSyntax, false, bad + ":2:8: unexpected end of file in \"(\""},
+		{"missing file", "", []string{filepath.Join(dir, "none.l")}, ExitUsage, false, "open " + filepath.Join(dir, "none.l") + ": no such file or directory"},
+		{"storage overflow", loop, []string{"-heap", "1000"}, ExitResources, false, "backtrace of storage overflow:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, status := runLisp(t, tt.stdin, tt.args...)
+			if status != tt.status {
+				t.Errorf("exit status %d, want %d", status, tt.status)
+			}
+			if totals := strings.Contains(stdout, "\nCalls to eval = "); totals != tt.totals {
+				t.Errorf("transcript %q: totals %v, want %v", stdout, totals, tt.totals)
+			}
+
+			// With -summary stderr they are a JSON line at the end of
+			// standard error instead, whatever the exit status.
+
+			stdout, stderr, status := runLisp(t, tt.stdin, append([]string{"-summary", "stderr"}, tt.args...)...)
+			if status != tt.status {
+				t.Errorf("with -summary stderr: exit status %d, want %d", status, tt.status)
+			}
+			if strings.Contains(stdout, "Calls to eval") {
+				t.Errorf("with -summary stderr: transcript %q has the totals", stdout)
+			}
+			lines := strings.Split(strings.TrimSuffix(stderr, "\n"), "\n")
+			if tt.stderr != "" && lines[0] != tt.stderr {
+				t.Errorf("standard error starts with %q, want %q", lines[0], tt.stderr)
+			}
+			var summary runSummary
+			if err := json.Unmarshal([]byte(lines[len(lines)-1]), &summary); err != nil {
+				t.Fatalf("summary %q: %v", lines[len(lines)-1], err)
+			}
+			if summary.Type != "summary" || summary.Exit != tt.status || summary.Status != exitStatusNames[tt.status] {
+				t.Errorf("summary %+v, want status %d, %s", summary, tt.status, exitStatusNames[tt.status])
+			}
+		})
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// --- Language Server ---
+
+// lspServer serves the Language Server Protocol for .l files: diagnostics
+// from the reader of the interpreter, hover help, go to definition and
+// completion. Documents are synchronized in full.
+type lspServer struct {
+	r    *bufio.Reader
+	w    io.Writer
+	docs map[string]*lspDoc
+}
+
+// lspDoc is an open document, read as a Program.
+type lspDoc struct {
+	prog *Program
+}
+
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  any              `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+// Severities of diagnostics, and kinds of completion items.
+const (
+	lspSevError   = 1
+	lspSevWarning = 2
+	lspFunction   = 3
+	lspVariable   = 6
+	lspKeyword    = 14
+	lspConstant   = 21
+)
+
+// lspMain serves the Language Server Protocol on standard input and output.
+func lspMain(args []string) int {
+	s := &lspServer{r: bufio.NewReader(os.Stdin), w: os.Stdout, docs: map[string]*lspDoc{}}
+	if err := s.serve(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitInternal
+	}
+	return ExitSuccess
+}
+
+func (s *lspServer) read() (*lspMessage, error) {
+	var msg lspMessage
+	if err := readMessage(s.r, &msg); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("lsp: %v", err)
+	}
+	return &msg, nil
+}
+
+func (s *lspServer) send(msg *lspMessage) {
+	msg.JSONRPC = "2.0"
+	writeMessage(s.w, msg)
+}
+
+// reply answers the request req. A nil result is sent as null.
+func (s *lspServer) reply(req *lspMessage, result any) {
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+	s.send(&lspMessage{ID: req.ID, Result: result})
+}
+
+func (s *lspServer) notify(method string, params any) {
+	body, _ := json.Marshal(params)
+	s.send(&lspMessage{Method: method, Params: body})
+}
+
+// serve handles messages until the exit notification or the end of input.
+func (s *lspServer) serve() error {
+	for {
+		msg, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch msg.Method {
+		case "initialize":
+			s.reply(msg, map[string]any{
+				"capabilities": map[string]any{
+					"textDocumentSync":   1,
+					"hoverProvider":      true,
+					"definitionProvider": true,
+					"completionProvider": map[string]any{},
+				},
+				"serverInfo": map[string]string{"name": "ait-lisp"},
+			})
+		case "shutdown":
+			s.reply(msg, nil)
+		case "exit":
+			return nil
+		case "textDocument/didOpen":
+			var p struct {
+				TextDocument struct {
+					URI  string `json:"uri"`
+					Text string `json:"text"`
+				} `json:"textDocument"`
+			}
+			json.Unmarshal(msg.Params, &p)
+			s.update(p.TextDocument.URI, p.TextDocument.Text)
+		case "textDocument/didChange":
+			var p struct {
+				TextDocument struct {
+					URI string `json:"uri"`
+				} `json:"textDocument"`
+				ContentChanges []struct {
+					Text string `json:"text"`
+				} `json:"contentChanges"`
+			}
+			json.Unmarshal(msg.Params, &p)
+			if n := len(p.ContentChanges); n > 0 {
+				s.update(p.TextDocument.URI, p.ContentChanges[n-1].Text)
+			}
+		case "textDocument/didClose":
+			var p lspTextPosition
+			json.Unmarshal(msg.Params, &p)
+			delete(s.docs, p.TextDocument.URI)
+			s.notify("textDocument/publishDiagnostics", map[string]any{"uri": p.TextDocument.URI, "diagnostics": []lspDiagnostic{}})
+		case "textDocument/hover":
+			s.hover(msg)
+		case "textDocument/definition":
+			s.definition(msg)
+		case "textDocument/completion":
+			s.completion(msg)
+		default:
+			if msg.ID != nil {
+				s.send(&lspMessage{ID: msg.ID, Error: &lspError{-32601, msg.Method + " is not supported"}})
+			}
+		}
+	}
+}
+
+// update reads the new text of a document and publishes its diagnostics.
+func (s *lspServer) update(uri, text string) {
+	d := &lspDoc{ReadProgram([]byte(text))}
+	s.docs[uri] = d
+	s.notify("textDocument/publishDiagnostics", map[string]any{"uri": uri, "diagnostics": d.diagnostics()})
+}
+
+// diagnostics reports where the reader fails, and the brackets and
+// parentheses that do not match: the reader takes a stray ")" for nil and a
+// stray "]" for an atom, and an unclosed "(" makes it read to the end.
+func (d *lspDoc) diagnostics() []lspDiagnostic {
+	src := d.prog.M.Source
+	diags := []lspDiagnostic{}
+	add := func(off, end, severity int, msg string) {
+		diags = append(diags, lspDiagnostic{lspRange{lspPos(src, off), lspPos(src, end)}, severity, "lisp", msg})
+	}
+	if e, ok := d.prog.Err.(*SyntaxError); ok {
+		off := lineOffset(src, e.Line-1) + e.Col - 1
+		add(off, off+1, lspSevError, e.Msg)
+	}
+	var open []Token
+	for _, w := range words(src) {
+		switch w.Text {
+		case "(":
+			open = append(open, w)
+		case ")":
+			if len(open) == 0 {
+				add(w.Off, w.End, lspSevWarning, "this ) closes no (, and reads as nil")
+				break
+			}
+			open = open[:len(open)-1]
+		case "]":
+			add(w.Off, w.End, lspSevWarning, "this ] closes no comment, and reads as an atom")
+		}
+	}
+	if d.prog.Overflow {
+		return diags // the rest of the source was not read
+	}
+	for _, w := range open {
+		add(w.Off, w.End, lspSevError, "this ( is never closed")
+	}
+	return diags
+}
+
+// words returns the tokens of src outside comments, as the reader sees
+// them. An unclosed comment runs to the end.
+func words(src []byte) []Token {
+	var list []Token
+	depth := 0
+	for _, t := range ScanTokens(src) {
+		switch {
+		case t.Text == "[":
+			depth++
+		case t.Text == "]" && depth > 0:
+			depth--
+		case depth == 0:
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// word returns the word of the document at pos, outside comments.
+func (d *lspDoc) word(pos lspPosition) (Token, bool) {
+	src := d.prog.M.Source
+	off := lspOffset(src, pos)
+	for _, w := range words(src) {
+		if w.Off <= off && off <= w.End && !isSeparator(int(w.Text[0]), true) {
+			return w, true
+		}
+	}
+	return Token{}, false
+}
+
+func (s *lspServer) position(msg *lspMessage) (*lspDoc, Token, bool) {
+	var p lspTextPosition
+	json.Unmarshal(msg.Params, &p)
+	d := s.docs[p.TextDocument.URI]
+	if d == nil {
+		return nil, Token{}, false
+	}
+	t, ok := d.word(p.Position)
+	return d, t, ok
+}
+
+func (s *lspServer) hover(msg *lspMessage) {
+	d, t, ok := s.position(msg)
+	if !ok {
+		s.reply(msg, nil)
+		return
+	}
+	text := builtinHelp(t.Text)
+	if defs := d.prog.Definitions(t.Text); len(defs) > 0 {
+		text = d.prog.defineHelp(defs[len(defs)-1])
+	}
+	if text == "" {
+		s.reply(msg, nil)
+		return
+	}
+	s.reply(msg, map[string]any{"contents": map[string]string{"kind": "markdown", "value": text}})
+}
+
+// defineHelp describes a define: how it is called, and its documentation.
+func (p *Program) defineHelp(f ProgramForm) string {
+	m := p.M
+	head := m.NameString(f.Name)
+	if f.Function {
+		head = "(" + strings.TrimPrefix(m.SexpString(m.Cons(f.Name, f.Params)), "(")
+	}
+	text := fmt.Sprintf("```\ndefine %s\n```", head)
+	if n := m.PrimArgs(f.Name); n > 0 {
+		text += fmt.Sprintf("\n\nM-expression arity %d.", n-1)
+	}
+	if f.Doc != "" {
+		text += "\n\n" + f.Doc
+	}
+	return text
+}
+
+// builtinHelp describes a symbol of the interpreter, with the number of
+// arguments the reader collects after it in M-expressions, or returns "".
+func builtinHelp(name string) string {
+	for _, b := range builtins() {
+		if b.name == name {
+			return fmt.Sprintf("`%s` is %s. In M-expressions it takes %s.", name, b.kind, plural(b.arity, "argument"))
+		}
+	}
+	return ""
+}
+
+func plural(n int, what string) string {
+	if n == 1 {
+		return "1 " + what
+	}
+	return fmt.Sprintf("%d %ss", n, what)
+}
+
+// builtin is a symbol of the interpreter: one of the specs of Init, or a
+// top-level command.
+type builtin struct {
+	name, kind string
+	arity      int
+	item       int // the kind of completion item
+}
+
+// builtins lists the symbols of the interpreter that programs use by name,
+// with the arities Init and the commands give them. It is computed once, on
+// a machine of its own.
+var builtins = sync.OnceValue(func() []builtin {
+	m := NewMachine(strings.NewReader(""), io.Discard)
+	m.Init()
+	var list []builtin
+	for o := m.ObjectList; o != Nil; o = m.Cdr(o) {
+		a := m.Car(o)
+		name := m.NameString(a)
+		switch a {
+		case Nil, m.LeftBracket, m.RightBracket, m.LeftParen, m.RightParen, m.DoubleQuote:
+			continue
+		}
+		if a >= m.Builtins || m.IsNumber(a) {
+			continue
+		}
+		b := builtin{name: name, kind: "a primitive function", arity: m.PrimArgs(a) - 1, item: lspFunction}
+		switch {
+		case m.PrimArgs(a) == 0:
+			b.kind, b.arity, b.item = "a constant", 0, lspConstant
+		case m.PrimCode(a) == PrimNone && a != m.SymEval:
+			b.kind, b.item = "a special form", lspKeyword
+		}
+		list = append(list, b)
+	}
+	for _, c := range m.commands() {
+		list = append(list, builtin{c.name, "a top-level command", c.args - 1, lspKeyword})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+})
+
+func (s *lspServer) definition(msg *lspMessage) {
+	var p lspTextPosition
+	json.Unmarshal(msg.Params, &p)
+	d, t, ok := s.position(msg)
+	if !ok {
+		s.reply(msg, nil)
+		return
+	}
+	locs := []lspLocation{}
+	for _, f := range d.prog.Definitions(t.Text) {
+		if nt, ok := d.prog.NameToken(f); ok {
+			src := d.prog.M.Source
+			locs = append(locs, lspLocation{p.TextDocument.URI, lspRange{lspPos(src, nt.Off), lspPos(src, nt.End)}})
+		}
+	}
+	s.reply(msg, locs)
+}
+
+func (s *lspServer) completion(msg *lspMessage) {
+	var p lspTextPosition
+	json.Unmarshal(msg.Params, &p)
+	items := []map[string]any{}
+	// A name defined again is completed with its last define, as hover
+	// shows it, in the place of its first.
+	defined := map[string]int{}
+	if d := s.docs[p.TextDocument.URI]; d != nil {
+		m := d.prog.M
+		for _, f := range d.prog.Forms {
+			if f.Name == Nil {
+				continue
+			}
+			name := m.NameString(f.Name)
+			kind := lspVariable
+			if f.Function {
+				kind = lspFunction
+			}
+			item := map[string]any{"label": name, "kind": kind, "detail": "define", "documentation": f.Doc}
+			if i, ok := defined[name]; ok {
+				items[i] = item
+				continue
+			}
+			defined[name] = len(items)
+			items = append(items, item)
+		}
+	}
+	for _, b := range builtins() {
+		if _, ok := defined[b.name]; !ok {
+			items = append(items, map[string]any{"label": b.name, "kind": b.item, "detail": fmt.Sprintf("%s, %s", b.kind, plural(b.arity, "argument"))})
+		}
+	}
+	s.reply(msg, items)
+}
+
+// lineOffset returns the offset in src where line, counted from 0, starts.
+func lineOffset(src []byte, line int) int {
+	off := 0
+	for ; line > 0 && off < len(src); off++ {
+		if src[off] == '\n' {
+			line--
+		}
+	}
+	return off
+}
+
+// lspPos returns offset off of src as a position, whose character counts
+// UTF-16 code units.
+func lspPos(src []byte, off int) lspPosition {
+	off = min(off, len(src))
+	line, col := sourcePos(src, off)
+	start := off - (col - 1)
+	n := 0
+	for _, r := range string(src[start:off]) {
+		n += len(utf16.AppendRune(nil, r))
+	}
+	return lspPosition{line - 1, n}
+}
+
+// lspOffset returns the offset in src of pos.
+func lspOffset(src []byte, pos lspPosition) int {
+	off := lineOffset(src, pos.Line)
+	for n := 0; n < pos.Character && off < len(src) && src[off] != '\n'; {
+		r, size := utf8.DecodeRune(src[off:])
+		n += len(utf16.AppendRune(nil, r))
+		off += size
+	}
+	return off
+}
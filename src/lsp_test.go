@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLSPDiagnostics(t *testing.T) {
+	tests := []struct {
+		name, src string
+		want      []string // line:character severity message
+	}{
+		{"none", "car '(a b)\n", nil},
+		{"incomplete form", "cons 'a\n", []string{"0:0 1 unexpected end of input in this form"}},
+		{"unclosed paren", "define (f x) x\n(f 'a", []string{
+			"1:0 1 unexpected end of input in this form",
+			"1:0 1 this ( is never closed",
+		}},
+		{"stray paren", "car ')\n", []string{"0:5 2 this ) closes no (, and reads as nil"}},
+		{"stray bracket", "car 'a ]\n", []string{"0:7 2 this ] closes no comment, and reads as an atom"}},
+		{"unclosed comment", "[ open\ncar 'a\n", []string{"0:0 1 comment is not closed"}},
+		{"overflow", "car '(a)\n'(" + strings.Repeat("a ", Size) + ")\n", []string{
+			"1:0 1 storage overflow reading this form",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, d := range (&lspDoc{ReadProgram([]byte(tt.src))}).diagnostics() {
+				got = append(got, fmt.Sprintf("%d:%d %d %s", d.Range.Start.Line, d.Range.Start.Character, d.Severity, d.Message))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diagnostics = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// lspSession sends msgs to an lspServer and returns its replies by id, and
+// the parameters of its notifications.
+func lspSession(t *testing.T, msgs ...map[string]any) (replies map[int]json.RawMessage, notes []json.RawMessage) {
+	t.Helper()
+	var in, out bytes.Buffer
+	for _, msg := range msgs {
+		msg["jsonrpc"] = "2.0"
+		writeMessage(&in, msg)
+	}
+	s := &lspServer{r: bufio.NewReader(&in), w: &out, docs: map[string]*lspDoc{}}
+	if err := s.serve(); err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	replies = map[int]json.RawMessage{}
+	r := bufio.NewReader(&out)
+	for {
+		var msg struct {
+			ID     *int
+			Result json.RawMessage
+			Params json.RawMessage
+		}
+		if err := readMessage(r, &msg); err != nil {
+			break
+		}
+		if msg.ID != nil {
+			replies[*msg.ID] = msg.Result
+		} else {
+			notes = append(notes, msg.Params)
+		}
+	}
+	return replies, notes
+}
+
+func TestLSPHover(t *testing.T) {
+	src := "[ wraps x in a list ]\ndefine (f x)\n   cons x nil\n(f 'a)\n"
+	hover := func(id, line, char int) map[string]any {
+		return map[string]any{"id": id, "method": "textDocument/hover", "params": map[string]any{
+			"textDocument": map[string]string{"uri": "file:///t.l"},
+			"position":     lspPosition{line, char},
+		}}
+	}
+	replies, notes := lspSession(t,
+		map[string]any{"id": 1, "method": "initialize", "params": map[string]any{}},
+		map[string]any{"method": "textDocument/didOpen", "params": map[string]any{
+			"textDocument": map[string]string{"uri": "file:///t.l", "text": src},
+		}},
+		hover(2, 2, 4),  // cons
+		hover(3, 3, 1),  // f
+		hover(4, 2, 8),  // x
+		hover(5, 0, 10), // a word of a comment
+		map[string]any{"id": 6, "method": "shutdown"},
+		map[string]any{"method": "exit"},
+	)
+	if len(notes) != 1 || !strings.Contains(string(notes[0]), `"diagnostics":[]`) {
+		t.Errorf("notifications = %s, want no diagnostics", notes)
+	}
+	tests := []struct {
+		id   int
+		want string
+	}{
+		{2, "`cons` is a primitive function. In M-expressions it takes 2 arguments."},
+		{3, "```\ndefine (f x)\n```\n\nwraps x in a list"},
+		{4, ""},
+		{5, ""},
+	}
+	for _, tt := range tests {
+		var got struct{ Contents struct{ Kind, Value string } }
+		if string(replies[tt.id]) != "null" {
+			if err := json.Unmarshal(replies[tt.id], &got); err != nil {
+				t.Fatalf("hover %d: %v", tt.id, err)
+			}
+		}
+		if got.Contents.Value != tt.want {
+			t.Errorf("hover %d = %q, want %q", tt.id, got.Contents.Value, tt.want)
+		}
+	}
+}
+
+// lspDefinesSrc defines f twice, and car and doc over the primitive and the
+// command. In M-expressions car would take (car x) as its argument, so it
+// is defined in S-expression syntax.
+const lspDefinesSrc = "[ one ]\ndefine (f x) x\n[ two ]\ndefine (f x y) cons x y\n\"(define (car x) x)\ndefine (doc x) cons x nil\n(f (car 'a) (doc 'b))\n"
+
+func lspOpen(src string, reqs ...map[string]any) []map[string]any {
+	msgs := []map[string]any{
+		{"id": 1, "method": "initialize", "params": map[string]any{}},
+		{"method": "textDocument/didOpen", "params": map[string]any{
+			"textDocument": map[string]string{"uri": "file:///t.l", "text": src},
+		}},
+	}
+	msgs = append(msgs, reqs...)
+	return append(msgs, map[string]any{"id": 99, "method": "shutdown"}, map[string]any{"method": "exit"})
+}
+
+func TestLSPDefinition(t *testing.T) {
+	definition := func(id, line, char int) map[string]any {
+		return map[string]any{"id": id, "method": "textDocument/definition", "params": map[string]any{
+			"textDocument": map[string]string{"uri": "file:///t.l"},
+			"position":     lspPosition{line, char},
+		}}
+	}
+	replies, _ := lspSession(t, lspOpen(lspDefinesSrc,
+		definition(2, 6, 1),  // f, defined twice
+		definition(3, 6, 4),  // car, defined over the primitive
+		definition(4, 6, 13), // doc, defined over the command
+		definition(5, 3, 15), // cons
+		definition(6, 6, 9),  // a, not defined
+		definition(7, 8, 0),  // past the end
+	)...)
+	tests := []struct {
+		id   int
+		want []string // line:character-line:character
+	}{
+		{2, []string{"1:8-1:9", "3:8-3:9"}},
+		{3, []string{"4:10-4:13"}},
+		{4, []string{"5:8-5:11"}},
+		{5, nil},
+		{6, nil},
+		{7, nil},
+	}
+	for _, tt := range tests {
+		var locs []lspLocation
+		if err := json.Unmarshal(replies[tt.id], &locs); err != nil {
+			t.Fatalf("definition %d: %v", tt.id, err)
+		}
+		var got []string
+		for _, l := range locs {
+			if l.URI != "file:///t.l" {
+				t.Errorf("definition %d in %s", tt.id, l.URI)
+			}
+			r := l.Range
+			got = append(got, fmt.Sprintf("%d:%d-%d:%d", r.Start.Line, r.Start.Character, r.End.Line, r.End.Character))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("definition %d = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestLSPCompletion(t *testing.T) {
+	replies, _ := lspSession(t, lspOpen(lspDefinesSrc,
+		map[string]any{"id": 2, "method": "textDocument/completion", "params": map[string]any{
+			"textDocument": map[string]string{"uri": "file:///t.l"},
+			"position":     lspPosition{6, 2},
+		}},
+	)...)
+	var items []struct {
+		Label, Detail, Documentation string
+		Kind                         int
+	}
+	if err := json.Unmarshal(replies[2], &items); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]string{}
+	for _, it := range items {
+		got[it.Label] = append(got[it.Label], fmt.Sprintf("%d %s: %s", it.Kind, it.Detail, it.Documentation))
+	}
+	// The defines come first, each once, with its last documentation;
+	// car and doc are no longer the primitive and the command.
+	if len(items) < 3 || items[0].Label != "f" || items[1].Label != "car" || items[2].Label != "doc" {
+		t.Errorf("items %v, want f, car and doc first", items)
+	}
+	for label, want := range map[string][]string{
+		"f":     {"3 define: two"},
+		"car":   {"3 define: "},
+		"doc":   {"3 define: "},
+		"cons":  {"3 a primitive function, 2 arguments: "},
+		"if":    {"14 a special form, 3 arguments: "},
+		"nil":   {"21 a constant, 0 arguments: "},
+		"arity": {"14 a top-level command, 2 arguments: "},
+	} {
+		if !reflect.DeepEqual(got[label], want) {
+			t.Errorf("completions of %s = %q, want %q", label, got[label], want)
+		}
+	}
+}
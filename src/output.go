@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// --- Transcripts ---
+
+// Output receives the events of a run and writes them as a transcript. Run
+// reports each top-level form as BeginForm, Read, a Record for each of its
+// results and EndForm; display and debug report an Event as they happen.
+type Output interface {
+	Start()
+	Echo(c int)
+	BeginForm()
+	Read()
+	Record(label string, x int)
+	Text(label, text string)
+	Event(e Event)
+	EndForm(f *Form)
+	End(s *Summary)
+}
+
+// Event is a display or debug output. Depth is the number of try calls it
+// happened in; a display inside a try is captured rather than printed.
+type Event struct {
+	Label string
+	X     int
+	Depth int
+}
+
+// Form describes a top-level form once it has been evaluated.
+type Form struct {
+	Source string
+	Expr   int
+	Value  int
+	Define bool
+	Name   int // the symbol of a define or a command
+	Doc    string
+	Events []Event
+
+	Evals, Conses int
+	Time          time.Duration // from the end of the reading of the form
+}
+
+// Summary gives the totals of a run. Overflow is set when the run ended
+// because the heap was used up, rather than at the end of the input.
+type Summary struct {
+	Evals, Conses int
+	Overflow      bool
+}
+
+var outputs = map[string]func(m *Machine) Output{
+	"classic": func(m *Machine) Output { return &classicOutput{m} },
+	"quiet":   func(m *Machine) Output { return &quietOutput{classicOutput{m}} },
+	"values":  func(m *Machine) Output { return &valuesOutput{m} },
+	"html":    func(m *Machine) Output { return &htmlOutput{m: m} },
+	"ndjson":  func(m *Machine) Output { return &jsonOutput{m: m, enc: json.NewEncoder(m.Writer)} },
+}
+
+// classicOutput writes the transcript of the original interpreters: the input
+// is echoed, and each result follows it with a label.
+type classicOutput struct {
+	m *Machine
+}
+
+func (o *classicOutput) Start() {
+	fmt.Fprintf(o.m.Writer, "LISP Interpreter Run\n")
+}
+
+func (o *classicOutput) Echo(c int) {
+	o.m.PutByte(c)
+}
+
+func (o *classicOutput) BeginForm() {
+	fmt.Fprintf(o.m.Writer, "\n")
+}
+
+func (o *classicOutput) Read() {
+	fmt.Fprintf(o.m.Writer, "\n")
+}
+
+func (o *classicOutput) Record(label string, x int) {
+	o.m.Print(label, x)
+}
+
+func (o *classicOutput) Text(label, text string) {
+	o.m.PrintText(label, text)
+}
+
+func (o *classicOutput) Event(e Event) {
+	if e.Label == "debug" || e.Depth == 0 {
+		o.m.Print(e.Label, e.X)
+	}
+}
+
+func (o *classicOutput) EndForm(f *Form) {}
+
+func (o *classicOutput) End(s *Summary) {
+	if s.Overflow {
+		// Like the original interpreter, which exits at once.
+		fmt.Fprintf(o.m.Writer, "Storage overflow!\n")
+		return
+	}
+	fmt.Fprintf(o.m.Writer, "End of LISP Run\n\nCalls to eval = %d\nCalls to cons = %d\n", s.Evals, s.Conses)
+}
+
+// quietOutput is the classic transcript without the echo of the input and
+// the blank lines around it.
+type quietOutput struct {
+	classicOutput
+}
+
+func (o *quietOutput) Echo(c int) {}
+func (o *quietOutput) BeginForm() {}
+func (o *quietOutput) Read()      {}
+
+// valuesOutput writes only the values of top-level expressions and what
+// they display, one per line without labels or wrapping, for use in shell
+// pipelines.
+type valuesOutput struct {
+	m *Machine
+}
+
+func (o *valuesOutput) Start()                     {}
+func (o *valuesOutput) Echo(c int)                 {}
+func (o *valuesOutput) BeginForm()                 {}
+func (o *valuesOutput) Read()                      {}
+func (o *valuesOutput) Record(label string, x int) {}
+func (o *valuesOutput) Text(label, text string)    {}
+
+func (o *valuesOutput) End(s *Summary) {
+	if s.Overflow {
+		fmt.Fprintf(o.m.Writer, "Storage overflow!\n")
+	}
+}
+
+func (o *valuesOutput) Event(e Event) {
+	if e.Label == "display" && e.Depth == 0 {
+		fmt.Fprintln(o.m.Writer, o.m.SexpString(e.X))
+	}
+}
+
+func (o *valuesOutput) EndForm(f *Form) {
+	if !f.Define && f.Name == Nil {
+		fmt.Fprintln(o.m.Writer, o.m.SexpString(f.Value))
+	}
+}
+
+// jsonOutput writes one JSON object per line for each top-level form, and one
+// for the summary at the end.
+type jsonOutput struct {
+	m   *Machine
+	enc *json.Encoder
+}
+
+type jsonForm struct {
+	Type       string   `json:"type"`
+	Source     string   `json:"source"`
+	Expression string   `json:"expression"`
+	Define     bool     `json:"define"`
+	Name       string   `json:"name,omitempty"`
+	Value      string   `json:"value"`
+	Doc        string   `json:"doc,omitempty"`
+	Displays   []string `json:"displays"`
+	Debugs     []string `json:"debugs"`
+	Evals      int      `json:"evals"`
+	Conses     int      `json:"conses"`
+}
+
+type jsonSummary struct {
+	Type     string `json:"type"`
+	Evals    int    `json:"evals"`
+	Conses   int    `json:"conses"`
+	Overflow bool   `json:"overflow,omitempty"`
+}
+
+func (o *jsonOutput) Start()                     {}
+func (o *jsonOutput) Echo(c int)                 {}
+func (o *jsonOutput) BeginForm()                 {}
+func (o *jsonOutput) Read()                      {}
+func (o *jsonOutput) Record(label string, x int) {}
+func (o *jsonOutput) Text(label, text string)    {}
+func (o *jsonOutput) Event(e Event)              {}
+
+func (o *jsonOutput) EndForm(f *Form) {
+	m := o.m
+	j := jsonForm{
+		Type:       "form",
+		Source:     f.Source,
+		Expression: m.SexpString(f.Expr),
+		Define:     f.Define,
+		Value:      m.SexpString(f.Value),
+		Doc:        f.Doc,
+		Displays:   []string{},
+		Debugs:     []string{},
+		Evals:      f.Evals,
+		Conses:     f.Conses,
+	}
+	if f.Name != Nil {
+		j.Name = m.SexpString(f.Name)
+	}
+	for _, e := range f.Events {
+		switch {
+		case e.Label == "debug":
+			j.Debugs = append(j.Debugs, m.SexpString(e.X))
+		case e.Depth == 0:
+			j.Displays = append(j.Displays, m.SexpString(e.X))
+		}
+	}
+	o.enc.Encode(j)
+}
+
+func (o *jsonOutput) End(s *Summary) {
+	o.enc.Encode(jsonSummary{"summary", s.Evals, s.Conses, s.Overflow})
+}
+
+// runSummary is the line "-summary stderr" writes at the end of a run.
+type runSummary struct {
+	Type    string  `json:"type"`
+	Status  string  `json:"status"`
+	Exit    int     `json:"exit"`
+	Evals   int     `json:"evals"`
+	Conses  int     `json:"conses"`
+	Seconds float64 `json:"seconds"`
+}
+
+// noSummaryOutput leaves the totals out of another Output, but not the end
+// of a run on a storage overflow.
+type noSummaryOutput struct {
+	Output
+}
+
+func (o *noSummaryOutput) End(s *Summary) {
+	if s.Overflow {
+		o.Output.End(s)
+	}
+}
+
+// SexpString returns the printed form of x, without wrapping.
+func (m *Machine) SexpString(x int) string {
+	var b strings.Builder
+	m.serialize(x, func(c int) { b.WriteByte(byte(c)) })
+	return b.String()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOutputModes(t *testing.T) {
+	const src = "define (f x) cons x nil\n(f 'a)\ndisplay car '(b)\ncar cdr '(a (b\n c))\n"
+	tests := []struct {
+		output string
+		width  int
+		want   string
+	}{
+		{"quiet", 50, "" +
+			"LISP Interpreter Run\n" +
+			"define      f\n" +
+			"value       (lambda (x) (cons x nil))\n" +
+			"expression  (f (' a))\n" +
+			"value       (a)\n" +
+			"expression  (display (car (' (b))))\n" +
+			"display     b\n" +
+			"value       b\n" +
+			"expression  (car (cdr (' (a (b c)))))\n" +
+			"value       (b c)\n" +
+			"End of LISP Run\n" +
+			"\n" +
+			"Calls to eval = 20\n" +
+			"Calls to cons = 579\n"},
+		{"quiet", 10, "" +
+			"LISP Interpreter Run\n" +
+			"define      f\n" +
+			"value       (lambda (x\n" +
+			"            ) (cons x \n" +
+			"            nil))\n" +
+			"expression  (f (' a))\n" +
+			"value       (a)\n" +
+			"expression  (display (\n" +
+			"            car (' (b)\n" +
+			"            )))\n" +
+			"display     b\n" +
+			"value       b\n" +
+			"expression  (car (cdr \n" +
+			"            (' (a (b c\n" +
+			"            )))))\n" +
+			"value       (b c)\n" +
+			"End of LISP Run\n" +
+			"\n" +
+			"Calls to eval = 20\n" +
+			"Calls to cons = 579\n"},
+		// Only what the expressions display and their values, never
+		// wrapped, and nothing for a define.
+		{"values", 10, "(a)\nb\nb\n(b c)\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.output, func(t *testing.T) {
+			var out bytes.Buffer
+			m := NewMachine(strings.NewReader(src), &out)
+			m.Width = tt.width
+			m.Out = outputs[tt.output](m)
+			if err := m.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("output\n%s\nwant\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
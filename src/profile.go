@@ -0,0 +1,281 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// --- Profiling ---
+
+// Profiler charges the calls of Eval and the conses of each top-level
+// expression to the innermost named function being applied: a lambda that
+// is the value of a symbol, a primitive, eval or try. Costs outside any of
+// them go to "<top>". It keeps a tree of the chains of applications, so that
+// it can give inclusive totals and write a profile for go tool pprof.
+type Profiler struct {
+	BaseHook
+	m *Machine
+
+	funcs  []string // the functions, "<top>" first
+	index  map[string]int
+	calls  []int
+	root   *profNode
+	cur    *profNode
+	evals  int // TimeEval and NextFree when costs were last charged
+	conses int
+}
+
+// profNode is a chain of applications, with the costs charged to its last
+// function while it was the innermost one.
+type profNode struct {
+	fn            int
+	parent        *profNode
+	children      map[int]*profNode
+	evals, conses int
+}
+
+// Profiler returns the profiler of m, and starts profiling.
+func (m *Machine) Profiler() *Profiler {
+	if m.profiler == nil {
+		p := &Profiler{m: m, index: map[string]int{}}
+		p.root = &profNode{fn: p.function("<top>"), children: map[int]*profNode{}}
+		p.cur = p.root
+		m.profiler = p
+		m.AddHook(p)
+	}
+	return m.profiler
+}
+
+func (p *Profiler) function(name string) int {
+	i, ok := p.index[name]
+	if !ok {
+		i = len(p.funcs)
+		p.index[name] = i
+		p.funcs = append(p.funcs, name)
+		p.calls = append(p.calls, 0)
+	}
+	return i
+}
+
+// counted reports whether the application of f, the value of name, is one
+// the profiler charges costs to.
+func (p *Profiler) counted(f, name int) bool {
+	m := p.m
+	if name == Nil {
+		return false
+	}
+	if m.IsAtom(f) {
+		return m.PrimCode(f) > PrimNone || f == m.SymEval || f == m.SymTry
+	}
+	return m.Car(f) == m.SymLambda
+}
+
+func (p *Profiler) charge() {
+	m := p.m
+	p.cur.evals += m.TimeEval - p.evals
+	p.cur.conses += m.NextFree - p.conses
+	p.evals, p.conses = m.TimeEval, m.NextFree
+}
+
+func (p *Profiler) Enter(e int) {
+	m := p.m
+	if m.EvalDepth == 1 {
+		// A new top-level expression. The costs of reading it are not
+		// charged, and a failure may have left applications unfinished.
+		p.cur = p.root
+		p.evals, p.conses = m.TimeEval, m.NextFree
+	}
+}
+
+func (p *Profiler) Leave(e, v int) {
+	if p.m.EvalDepth == 0 {
+		p.charge()
+	}
+}
+
+func (p *Profiler) Apply(f, name, args int) {
+	if !p.counted(f, name) {
+		return
+	}
+	p.charge()
+	fn := p.function(p.m.NameString(name))
+	p.calls[fn]++
+	child := p.cur.children[fn]
+	if child == nil {
+		child = &profNode{fn: fn, parent: p.cur, children: map[int]*profNode{}}
+		p.cur.children[fn] = child
+	}
+	p.cur = child
+}
+
+func (p *Profiler) Return(f, name, args, v int) {
+	if !p.counted(f, name) || p.cur.parent == nil {
+		return
+	}
+	p.charge()
+	p.cur = p.cur.parent
+}
+
+// ProfileEntry gives the costs of a function. The exclusive costs are those
+// charged while it was the innermost function, and the inclusive ones those
+// charged while it was being applied at all.
+type ProfileEntry struct {
+	Name                  string
+	Calls                 int
+	Evals, Conses         int
+	InclEvals, InclConses int
+}
+
+// Entries returns the costs of each function, the costliest in evals first.
+func (p *Profiler) Entries() []ProfileEntry {
+	entries := make([]ProfileEntry, len(p.funcs))
+	for i, name := range p.funcs {
+		entries[i] = ProfileEntry{Name: name, Calls: p.calls[i]}
+	}
+	p.walk(p.root, func(n *profNode) {
+		entries[n.fn].Evals += n.evals
+		entries[n.fn].Conses += n.conses
+		seen := map[int]bool{}
+		for a := n; a != nil; a = a.parent {
+			if !seen[a.fn] {
+				seen[a.fn] = true
+				entries[a.fn].InclEvals += n.evals
+				entries[a.fn].InclConses += n.conses
+			}
+		}
+	})
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Evals != entries[j].Evals {
+			return entries[i].Evals > entries[j].Evals
+		}
+		return entries[i].InclEvals > entries[j].InclEvals
+	})
+	return entries
+}
+
+func (p *Profiler) walk(n *profNode, visit func(n *profNode)) {
+	visit(n)
+	keys := make([]int, 0, len(n.children))
+	for k := range n.children {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		p.walk(n.children[k], visit)
+	}
+}
+
+// WriteReport writes a table of the costs of each function to w.
+func (p *Profiler) WriteReport(w io.Writer) {
+	fmt.Fprintf(w, "%8s %10s %10s %10s %10s  %s\n", "calls", "evals", "incl", "conses", "incl", "function")
+	for _, e := range p.Entries() {
+		if e.InclEvals == 0 && e.InclConses == 0 && e.Calls == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%8d %10d %10d %10d %10d  %s\n", e.Calls, e.Evals, e.InclEvals, e.Conses, e.InclConses, e.Name)
+	}
+}
+
+// WritePprof writes the profile to w in the gzipped protocol buffer format
+// of go tool pprof, with the samples "evals" and "conses". Each chain of
+// applications is a stack of functions, so pprof can draw Lisp-level flame
+// graphs.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	strs := []string{""}
+	str := func(s string) int64 {
+		strs = append(strs, s)
+		return int64(len(strs) - 1)
+	}
+	var prof protoBuf
+	for _, t := range []string{"evals", "conses"} {
+		var vt protoBuf
+		vt.int(1, str(t))
+		vt.int(2, str("count"))
+		prof.bytes(1, vt.b)
+	}
+	p.walk(p.root, func(n *profNode) {
+		if n.evals == 0 && n.conses == 0 {
+			return
+		}
+		var locs []int64
+		for a := n; a != nil; a = a.parent {
+			locs = append(locs, int64(a.fn+1))
+		}
+		var s protoBuf
+		s.packed(1, locs)
+		s.packed(2, []int64{int64(n.evals), int64(n.conses)})
+		prof.bytes(2, s.b)
+	})
+	for i := range p.funcs {
+		var line, loc protoBuf
+		line.int(1, int64(i+1))
+		loc.int(1, int64(i+1))
+		loc.bytes(4, line.b)
+		prof.bytes(4, loc.b)
+	}
+	// A function has no system name, as pprof would demangle a name equal
+	// to it, and drop "<top>" as if it were the arguments of a template.
+	for i, name := range p.funcs {
+		var fn protoBuf
+		fn.int(1, int64(i+1))
+		fn.int(2, str(name))
+		fn.int(4, str("lisp"))
+		prof.bytes(5, fn.b)
+	}
+	for _, s := range strs {
+		prof.bytes(6, []byte(s))
+	}
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(prof.b); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// protoBuf encodes the fields of a protocol buffer message.
+type protoBuf struct {
+	b []byte
+}
+
+func (p *protoBuf) varint(x uint64) {
+	for x >= 0x80 {
+		p.b = append(p.b, byte(x)|0x80)
+		x >>= 7
+	}
+	p.b = append(p.b, byte(x))
+}
+
+func (p *protoBuf) int(field int, x int64) {
+	p.varint(uint64(field) << 3)
+	p.varint(uint64(x))
+}
+
+func (p *protoBuf) bytes(field int, b []byte) {
+	p.varint(uint64(field)<<3 | 2)
+	p.varint(uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *protoBuf) packed(field int, xs []int64) {
+	var q protoBuf
+	for _, x := range xs {
+		q.varint(uint64(x))
+	}
+	p.bytes(field, q.b)
+}
+
+// writePprof writes the profile of m to the file name.
+func writePprof(m *Machine, name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := m.Profiler().WritePprof(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
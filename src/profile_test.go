@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// profileSrc calls f recursively, so that f is on the stack several times.
+const profileSrc = "define (f n) if = n 0 nil cons n (f - n 1)\n(f 3)\n"
+
+func runProfile(t *testing.T) *Profiler {
+	t.Helper()
+	m := NewMachine(strings.NewReader(profileSrc), io.Discard)
+	p := m.Profiler()
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestProfilerEntries(t *testing.T) {
+	// The inclusive costs of f count each eval once, however many
+	// applications of f it happened inside.
+	want := []ProfileEntry{
+		{"f", 4, 52, 27, 52, 33},
+		{"<top>", 0, 3, 1, 55, 34},
+		{"=", 4, 0, 0, 0, 0},
+		{"-", 3, 0, 3, 0, 3},
+		{"cons", 3, 0, 3, 0, 3},
+	}
+	if got := runProfile(t).Entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Entries() = %+v, want %+v", got, want)
+	}
+}
+
+// uvarint decodes the varint at the start of b, and returns the rest of b.
+func uvarint(t *testing.T, b []byte) (uint64, []byte) {
+	t.Helper()
+	var x uint64
+	for i, s := 0, 0; i < len(b); i, s = i+1, s+7 {
+		x |= uint64(b[i]&0x7f) << s
+		if b[i] < 0x80 {
+			return x, b[i+1:]
+		}
+	}
+	t.Fatal("truncated varint")
+	return 0, nil
+}
+
+// protoFields decodes a protocol buffer message into the values of its
+// fields: a uint64 for a varint and a []byte for a length-delimited field.
+func protoFields(t *testing.T, b []byte) map[int][]any {
+	t.Helper()
+	fields := map[int][]any{}
+	for len(b) > 0 {
+		var key, x uint64
+		key, b = uvarint(t, b)
+		switch key & 7 {
+		case 0:
+			x, b = uvarint(t, b)
+			fields[int(key>>3)] = append(fields[int(key>>3)], x)
+		case 2:
+			x, b = uvarint(t, b)
+			fields[int(key>>3)] = append(fields[int(key>>3)], b[:x])
+			b = b[x:]
+		default:
+			t.Fatalf("wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+// unpack decodes packed varints.
+func unpack(t *testing.T, b []byte) []uint64 {
+	t.Helper()
+	var xs []uint64
+	for len(b) > 0 {
+		var x uint64
+		x, b = uvarint(t, b)
+		xs = append(xs, x)
+	}
+	return xs
+}
+
+func TestWritePprof(t *testing.T) {
+	p := runProfile(t)
+	var buf bytes.Buffer
+	if err := p.WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := protoFields(t, data)
+	var strs []string
+	for _, s := range prof[6] {
+		strs = append(strs, string(s.([]byte)))
+	}
+
+	// Every function has its name and a file name, and no system name.
+	names := map[uint64]string{}
+	for _, f := range prof[5] {
+		fn := protoFields(t, f.([]byte))
+		if len(fn[2]) != 1 || len(fn[4]) != 1 || len(fn[3]) != 0 {
+			t.Fatalf("function %v: want a name and a file name only", fn)
+		}
+		names[fn[1][0].(uint64)] = strs[fn[2][0].(uint64)]
+	}
+	// Every location has a line in a function.
+	locs := map[uint64]string{}
+	for _, l := range prof[4] {
+		loc := protoFields(t, l.([]byte))
+		if len(loc[4]) != 1 {
+			t.Fatalf("location %v: want one line", loc)
+		}
+		line := protoFields(t, loc[4][0].([]byte))
+		locs[loc[1][0].(uint64)] = names[line[1][0].(uint64)]
+	}
+	// The samples add up to the totals, by their innermost function, and
+	// each stack ends at "<top>".
+	evals, conses := map[string]int{}, map[string]int{}
+	for _, s := range prof[2] {
+		sample := protoFields(t, s.([]byte))
+		ids := unpack(t, sample[1][0].([]byte))
+		vs := unpack(t, sample[2][0].([]byte))
+		if top := locs[ids[len(ids)-1]]; top != "<top>" {
+			t.Errorf("stack %v ends at %q", ids, top)
+		}
+		evals[locs[ids[0]]] += int(vs[0])
+		conses[locs[ids[0]]] += int(vs[1])
+	}
+	for _, e := range p.Entries() {
+		if evals[e.Name] != e.Evals || conses[e.Name] != e.Conses {
+			t.Errorf("samples of %s: %d evals, %d conses, want %d, %d", e.Name, evals[e.Name], conses[e.Name], e.Evals, e.Conses)
+		}
+	}
+}
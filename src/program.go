@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+// --- Reading Programs ---
+
+// ProgramForm is a top-level form of a program as the reader read it.
+type ProgramForm struct {
+	Expr       int
+	Start, End int // the span of its words in Source
+	Name       int // the symbol a define defines, or Nil
+	Params     int // the parameters of a define of a function, or Nil
+	Def        int // the body or value of a define
+	Function   bool
+	Command    bool // the form is a command, such as arity or doc
+	Doc        string
+}
+
+// Program is a source file read by the reader of the interpreter, without
+// evaluating it. Arity declarations take effect as they are read, so the
+// forms are those a run would read. M holds the atoms of the program, with
+// the Positions of its lists in M.Source.
+type Program struct {
+	M        *Machine
+	Forms    []ProgramForm
+	Err      error // a SyntaxError if the source ends inside a form or a comment
+	Overflow bool  // reading stopped when storage overflowed, which Err reports
+}
+
+// ReadProgram reads src as the interpreter would.
+func ReadProgram(src []byte) (p *Program) {
+	if len(src) > 0 && src[len(src)-1] != '\n' {
+		src = append(src[:len(src):len(src)], '\n')
+	}
+	m := NewMachine(bytes.NewReader(src), io.Discard)
+	m.Init()
+	m.Positions = map[int]int{}
+	p = &Program{M: m}
+	defer func() {
+		if r := recover(); r != nil {
+			switch r {
+			case errEndOfInput:
+				p.Err = m.incompleteForm()
+			case errStorageOverflow:
+				// The reader takes in a line at a time, so the form may not
+				// have started yet.
+				off := m.formStart
+				if off < 0 {
+					off = bytes.LastIndexByte(m.Source, '\n') + 1
+				}
+				line, col := sourcePos(m.Source, off)
+				p.Err = &SyntaxError{line, col, "storage overflow reading this form"}
+				p.Overflow = true
+			default:
+				panic(r)
+			}
+		}
+	}()
+	for {
+		m.beginForm()
+		e := m.Read(true, false)
+		f := ProgramForm{Expr: e, Start: m.formStart, End: m.formEnd, Name: Nil, Params: Nil, Def: Nil, Command: m.formCommand}
+		switch head := m.Car(e); {
+		case m.IsAtom(e):
+		case f.Command:
+			if head == m.SymArity {
+				m.DeclareArity(m.Car(m.Cdr(e)), m.Car(m.Cdr(m.Cdr(e))))
+			}
+		case head == m.SymDefine:
+			f.Name, f.Def = m.Car(m.Cdr(e)), m.Car(m.Cdr(m.Cdr(e)))
+			if !m.IsAtom(f.Name) {
+				f.Params, f.Name = m.Cdr(f.Name), m.Car(f.Name)
+				f.Function = true
+			}
+			f.Doc = m.formDoc()
+		}
+		p.Forms = append(p.Forms, f)
+	}
+}
+
+// Definitions returns the forms that define name, in order.
+func (p *Program) Definitions(name string) []ProgramForm {
+	var forms []ProgramForm
+	for _, f := range p.Forms {
+		if f.Name != Nil && p.M.NameString(f.Name) == name {
+			forms = append(forms, f)
+		}
+	}
+	return forms
+}
+
+// NameToken returns the word that names what the define f defines.
+func (p *Program) NameToken(f ProgramForm) (Token, bool) {
+	name := p.M.NameString(f.Name)
+	for _, t := range ScanTokens(p.M.Source[f.Start:f.End]) {
+		if t.Text == name && t.Off > 0 {
+			t.Off += f.Start
+			t.End += f.Start
+			t.Line, t.Col = sourcePos(p.M.Source, t.Off)
+			return t, true
+		}
+	}
+	return Token{}, false
+}
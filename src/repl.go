@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// --- Interactive REPL ---
+
+const (
+	replPrompt       = "lisp> "
+	replContinuation = "  ... "
+	historySize      = 1000
+)
+
+// IsTerminal reports whether f is a terminal.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// NeedsMore reports whether the reader is in the middle of a top-level form,
+// so that the next line of input continues it.
+func (m *Machine) NeedsMore() bool {
+	return m.formStart >= 0 || m.commentDepth > 0
+}
+
+// AtomNames returns the names of all interned atoms, sorted.
+func (m *Machine) AtomNames() []string {
+	var names []string
+	seen := map[string]bool{}
+	for i := m.ObjectList; !m.IsAtom(i); i = m.Cdr(i) {
+		name := m.NameString(m.Car(i))
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// replInput is the input of a machine in the REPL: it prompts for a line
+// whenever the reader needs one. At the prompt it saves the value stacks of
+// the atoms and the state of try, which abort restores.
+type replInput struct {
+	m      *Machine
+	editor *LineEditor
+	buf    []byte
+
+	values                                   map[int]int
+	tapes, buffer2, displayEnabled, displays int
+}
+
+func (r *replInput) Read(p []byte) (int, error) {
+	m := r.m
+	for len(r.buf) == 0 {
+		prompt := replPrompt
+		if m.NeedsMore() {
+			prompt = replContinuation
+		} else {
+			r.save()
+		}
+		line, err := r.editor.ReadLine(prompt)
+		// A Ctrl-C typed after the last evaluation ended interrupts
+		// nothing.
+		m.interrupted.Store(false)
+		if errors.Is(err, errInterrupt) {
+			// Ctrl-C drops the line being edited; the lines of the
+			// form that were already entered stay read.
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.buf = []byte(line + "\n")
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *replInput) save() {
+	m := r.m
+	clear(r.values)
+	for o := m.ObjectList; o != Nil; o = m.Cdr(o) {
+		r.values[m.Car(o)] = m.Value(m.Car(o))
+	}
+	r.tapes, r.buffer2, r.displayEnabled, r.displays = m.Tapes, m.Buffer2, m.DisplayEnabled, m.CapturedDisplays
+}
+
+// abort undoes what an interrupted evaluation left behind: the bindings of
+// the lambdas, eval and try calls in progress, the applications on Stack,
+// and the rest of the input. Definitions made before it stay.
+func (r *replInput) abort() {
+	m := r.m
+	for o := m.ObjectList; o != Nil; o = m.Cdr(o) {
+		a := m.Car(o)
+		v, ok := r.values[a]
+		if !ok {
+			// Interned since the prompt: keep only its global value.
+			for v = m.Value(a); m.Cdr(v) != Nil; v = m.Cdr(v) {
+			}
+		}
+		m.SetValue(a, v)
+	}
+	m.Tapes, m.Buffer2, m.DisplayEnabled, m.CapturedDisplays = r.tapes, r.buffer2, r.displayEnabled, r.displays
+	m.TryDepth, m.EvalDepth = 0, 0
+	m.Stack, m.failure = m.Stack[:0], nil
+	m.InWordBuffer, m.commentDepth = Nil, 0
+	m.interrupted.Store(false)
+	r.buf = nil
+	m.Reader.Reset(r)
+}
+
+// replOutput is the quiet transcript, since the terminal already shows the
+// input.
+type replOutput struct {
+	quietOutput
+}
+
+func (o *replOutput) Start() {
+	fmt.Fprintf(o.m.Writer, "AIT LISP. End the input with Ctrl-D.\n")
+}
+
+// withBase returns o with the transcript under its wrappers, such as the
+// cost records of statsOutput, replaced by base.
+func withBase(o, base Output) Output {
+	switch w := o.(type) {
+	case *statsOutput:
+		w.Output = withBase(w.Output, base)
+		return w
+	case *noSummaryOutput:
+		w.Output = withBase(w.Output, base)
+		return w
+	}
+	return base
+}
+
+// RunREPL runs m interactively on the terminal in and out, keeping the
+// wrappers of m.Out around the REPL transcript. Ctrl-C during an evaluation
+// abandons the form and prompts again. It returns the error Run would.
+func (m *Machine) RunREPL(in *os.File, out io.Writer) error {
+	editor := NewLineEditor(in, out)
+	editor.Complete = m.AtomNames
+	editor.Interrupt = m.Interrupt
+	editor.LoadHistory(historyFile())
+	if editor.Start() == nil {
+		defer editor.Stop()
+	}
+	m.editor = editor
+	input := &replInput{m: m, editor: editor, values: map[int]int{}}
+	m.Reader = bufio.NewReader(input)
+	m.Writer = out
+	m.Out = withBase(m.Out, &replOutput{quietOutput{classicOutput{m}}})
+	var err error
+	if m.NextFree > 0 {
+		// The machine has run files already: keep their definitions.
+		m.Out.Start()
+		err = m.Continue()
+	} else {
+		err = m.Run()
+	}
+	for err == errInterrupted {
+		fmt.Fprintf(out, "interrupted\n")
+		input.abort()
+		err = m.Continue()
+	}
+	return err
+}
+
+func historyFile() string {
+	if name := os.Getenv("LISP_HISTORY"); name != "" {
+		return name
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ait_lisp_history")
+}
+
+// --- Line Editor ---
+
+var errInterrupt = errors.New("interrupt")
+
+// LineEditor reads lines from a terminal with Emacs-style editing keys,
+// history and completion. When the terminal cannot be put into raw mode it
+// reads plain lines.
+type LineEditor struct {
+	in       *os.File
+	out      io.Writer
+	r        *bufio.Reader
+	history  []string
+	histFile string
+
+	// Complete returns the words to complete from.
+	Complete func() []string
+	// Interrupt is called for a Ctrl-C typed during a session while no
+	// line is being read, such as during an evaluation.
+	Interrupt func()
+
+	raw     *termState // the mode to restore at the end of a session
+	keys    chan key   // what the terminal sent during a session
+	mu      sync.Mutex
+	reading bool
+}
+
+// key is a character read from the terminal, or the error that ended the
+// input.
+type key struct {
+	r   rune
+	err error
+}
+
+func NewLineEditor(in *os.File, out io.Writer) *LineEditor {
+	return &LineEditor{in: in, out: out, r: bufio.NewReader(in)}
+}
+
+// LoadHistory reads the history from name, and appends new lines to it.
+func (e *LineEditor) LoadHistory(name string) {
+	e.histFile = name
+	if name == "" {
+		return
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+	if len(e.history) > historySize {
+		e.history = e.history[len(e.history)-historySize:]
+	}
+}
+
+func (e *LineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if e.histFile == "" {
+		return
+	}
+	f, err := os.OpenFile(e.histFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(f, line)
+	f.Close()
+}
+
+// Start begins a session: the terminal stays in raw mode until Stop, and
+// is read all the time, so that a Ctrl-C typed between lines reaches
+// Interrupt. It fails if the terminal cannot be put into raw mode.
+func (e *LineEditor) Start() error {
+	raw, err := makeRaw(e.in)
+	if err != nil {
+		return err
+	}
+	e.raw = raw
+	e.keys = make(chan key, 256)
+	go e.readKeys()
+	return nil
+}
+
+// Stop ends the session, restoring the mode of the terminal.
+func (e *LineEditor) Stop() {
+	if e.raw != nil {
+		restoreTerm(e.in, e.raw)
+		e.raw = nil
+	}
+}
+
+func (e *LineEditor) readKeys() {
+	for {
+		r, _, err := e.r.ReadRune()
+		e.mu.Lock()
+		interrupt := err == nil && r == 3 && !e.reading && e.Interrupt != nil
+		e.mu.Unlock()
+		if interrupt {
+			e.Interrupt()
+			continue
+		}
+		e.keys <- key{r, err}
+		if err != nil {
+			close(e.keys)
+			return
+		}
+	}
+}
+
+// readRune returns the next character typed.
+func (e *LineEditor) readRune() (rune, error) {
+	if e.keys == nil {
+		r, _, err := e.r.ReadRune()
+		return r, err
+	}
+	k, ok := <-e.keys
+	if !ok {
+		return 0, io.EOF
+	}
+	return k.r, k.err
+}
+
+func (e *LineEditor) setReading(reading bool) {
+	e.mu.Lock()
+	e.reading = reading
+	e.mu.Unlock()
+}
+
+// ReadLine prompts for a line and returns it without the newline. It
+// returns io.EOF for Ctrl-D on an empty line, and errInterrupt for Ctrl-C.
+// Outside a session the terminal is in raw mode while the line is read.
+func (e *LineEditor) ReadLine(prompt string) (string, error) {
+	if e.raw == nil {
+		raw, err := makeRaw(e.in)
+		if err != nil {
+			return e.readPlain(prompt)
+		}
+		defer restoreTerm(e.in, raw)
+	}
+	e.setReading(true)
+	defer e.setReading(false)
+	line, err := e.edit(prompt)
+	if err == nil {
+		e.addHistory(line)
+	}
+	return line, err
+}
+
+func (e *LineEditor) readPlain(prompt string) (string, error) {
+	fmt.Fprint(e.out, prompt)
+	line, err := e.r.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// lineState is a line being edited: its runes and the cursor position.
+type lineState struct {
+	prompt string
+	buf    []rune
+	pos    int
+}
+
+func (e *LineEditor) refresh(s *lineState) {
+	tail := len(s.buf) - s.pos
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", s.prompt, string(s.buf))
+	if tail > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", tail)
+	}
+}
+
+func (e *LineEditor) insert(s *lineState, r ...rune) {
+	s.buf = append(s.buf[:s.pos], append(r, s.buf[s.pos:]...)...)
+	s.pos += len(r)
+}
+
+func (e *LineEditor) edit(prompt string) (string, error) {
+	s := &lineState{prompt: prompt}
+	hist := len(e.history)
+	current := ""
+	tabs := 0
+	e.refresh(s)
+	for {
+		r, err := e.readRune()
+		if err != nil {
+			return "", err
+		}
+		if r != '\t' {
+			tabs = 0
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(s.buf), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupt
+		case 4: // Ctrl-D
+			if len(s.buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if s.pos < len(s.buf) {
+				s.buf = append(s.buf[:s.pos], s.buf[s.pos+1:]...)
+			}
+		case 1: // Ctrl-A
+			s.pos = 0
+		case 5: // Ctrl-E
+			s.pos = len(s.buf)
+		case 2: // Ctrl-B
+			if s.pos > 0 {
+				s.pos--
+			}
+		case 6: // Ctrl-F
+			if s.pos < len(s.buf) {
+				s.pos++
+			}
+		case 8, 127: // Backspace
+			if s.pos > 0 {
+				s.buf = append(s.buf[:s.pos-1], s.buf[s.pos:]...)
+				s.pos--
+			}
+		case 11: // Ctrl-K
+			s.buf = s.buf[:s.pos]
+		case 21: // Ctrl-U
+			s.buf = s.buf[s.pos:]
+			s.pos = 0
+		case 23: // Ctrl-W
+			start := s.pos
+			for start > 0 && s.buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && s.buf[start-1] != ' ' {
+				start--
+			}
+			s.buf = append(s.buf[:start], s.buf[s.pos:]...)
+			s.pos = start
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case 16, 14: // Ctrl-P, Ctrl-N
+			hist, current = e.recall(s, hist, current, r == 16)
+		case '\t':
+			tabs++
+			e.complete(s, tabs)
+		case 27: // escape sequences for the arrow, home, end and delete keys
+			seq := e.escape()
+			switch seq {
+			case "[A", "OA":
+				hist, current = e.recall(s, hist, current, true)
+			case "[B", "OB":
+				hist, current = e.recall(s, hist, current, false)
+			case "[C", "OC":
+				if s.pos < len(s.buf) {
+					s.pos++
+				}
+			case "[D", "OD":
+				if s.pos > 0 {
+					s.pos--
+				}
+			case "[H", "OH", "[1~":
+				s.pos = 0
+			case "[F", "OF", "[4~":
+				s.pos = len(s.buf)
+			case "[3~":
+				if s.pos < len(s.buf) {
+					s.buf = append(s.buf[:s.pos], s.buf[s.pos+1:]...)
+				}
+			}
+		default:
+			if r >= ' ' && r != utf8.RuneError {
+				e.insert(s, r)
+			}
+		}
+		e.refresh(s)
+	}
+}
+
+// escape reads the rest of an escape sequence.
+func (e *LineEditor) escape() string {
+	var seq []rune
+	for {
+		b, err := e.readRune()
+		if err != nil {
+			return string(seq)
+		}
+		seq = append(seq, b)
+		if len(seq) > 1 && (b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b == '~') {
+			return string(seq)
+		}
+		if len(seq) > 8 {
+			return ""
+		}
+	}
+}
+
+// recall replaces the line by the previous or next line of the history.
+// current keeps the line that was being edited before.
+func (e *LineEditor) recall(s *lineState, hist int, current string, back bool) (int, string) {
+	if hist == len(e.history) {
+		current = string(s.buf)
+	}
+	if back && hist > 0 {
+		hist--
+	} else if !back && hist < len(e.history) {
+		hist++
+	} else {
+		return hist, current
+	}
+	line := current
+	if hist < len(e.history) {
+		line = e.history[hist]
+	}
+	s.buf = []rune(line)
+	s.pos = len(s.buf)
+	return hist, current
+}
+
+// complete completes the word before the cursor from the Complete words.
+// A second Tab lists the candidates when there is more than one.
+func (e *LineEditor) complete(s *lineState, tabs int) {
+	if e.Complete == nil {
+		return
+	}
+	start := s.pos
+	for start > 0 && !isSeparator(int(s.buf[start-1]), true) {
+		start--
+	}
+	prefix := string(s.buf[start:s.pos])
+	if prefix == "" {
+		return
+	}
+	var matches []string
+	for _, w := range e.Complete() {
+		if strings.HasPrefix(w, prefix) {
+			matches = append(matches, w)
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+	common := []rune(matches[0])
+	for _, w := range matches[1:] {
+		for !strings.HasPrefix(w, string(common)) {
+			common = common[:len(common)-1]
+		}
+	}
+	if n := s.pos - start; len(common) > n {
+		e.insert(s, common[n:]...)
+	}
+	if len(matches) == 1 {
+		e.insert(s, ' ')
+	} else if tabs > 1 {
+		fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(matches, "  "))
+	}
+}
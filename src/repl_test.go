@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// keyEditor returns a LineEditor in a session that reads the keys of input,
+// as if typed on a terminal in raw mode.
+func keyEditor(input string) (*LineEditor, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	e := &LineEditor{out: out, r: bufio.NewReader(strings.NewReader(input)), raw: &termState{}, keys: make(chan key, 256)}
+	go e.readKeys()
+	return e, out
+}
+
+func TestLineEditor(t *testing.T) {
+	tests := []struct {
+		name, keys, want string
+		err              error
+	}{
+		{"line", "car x\r", "car x", nil},
+		{"newline", "car x\n", "car x", nil},
+		{"backspace", "carr\x7f x\r", "car x", nil},
+		{"insert", "cr\x02a\r", "car", nil},
+		{"start and end", "ar\x01c\x05 x\r", "car x", nil},
+		{"kill to end", "car x\x02\x02\x0b\r", "car", nil},
+		{"kill to start", "cdr car x\x02\x02\x02\x02\x02\x15\r", "car x", nil},
+		{"kill word", "car cdr\x17x\r", "car x", nil},
+		{"arrow keys", "ar\x1b[D\x1b[Dc\x1b[C\x1b[C x\r", "car x", nil},
+		{"home and delete", "xcar\x1b[H\x1b[3~\r", "car", nil},
+		{"runes", "ëtoil\x02\x02\x02x\x7f\x05e\r", "ëtoile", nil},
+		{"ctrl-d deletes", "carx\x02\x04\r", "car", nil},
+		{"ctrl-d ends", "\x04", "", io.EOF},
+		{"ctrl-c", "car\x03", "", errInterrupt},
+		{"end of input", "car", "", io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _ := keyEditor(tt.keys)
+			got, err := e.ReadLine("> ")
+			if got != tt.want || err != tt.err {
+				t.Errorf("ReadLine = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestLineEditorHistory(t *testing.T) {
+	hist := filepath.Join(t.TempDir(), "history")
+	os.WriteFile(hist, []byte("car x\n"), 0600)
+	e, _ := keyEditor("cdr y\r\x10\x10\r\x1b[A\x1b[B\x1b[Bnew\r  \r")
+	e.LoadHistory(hist)
+	for _, want := range []string{"cdr y", "car x", "new", "  "} {
+		if got, err := e.ReadLine("> "); got != want || err != nil {
+			t.Errorf("ReadLine = %q, %v, want %q", got, err, want)
+		}
+	}
+	data, _ := os.ReadFile(hist)
+	if want := "car x\ncdr y\ncar x\nnew\n"; string(data) != want {
+		t.Errorf("history file %q, want %q", data, want)
+	}
+}
+
+func TestLineEditorComplete(t *testing.T) {
+	words := func() []string { return []string{"car", "cdr", "cons", "ëtoile", "ëtude"} }
+	tests := []struct {
+		name, keys, want, listed string
+	}{
+		{"unique", "(ca\t\r", "(car ", ""},
+		{"common prefix", "ëto\t\r", "ëtoile ", ""},
+		{"ambiguous", "c\t\r", "c", ""},
+		{"listed", "c\t\t\r", "c", "car  cdr  cons"},
+		{"runes", "ë\t\t\r", "ët", "ëtoile  ëtude"},
+		{"no match", "x\t\r", "x", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, out := keyEditor(tt.keys)
+			e.Complete = words
+			got, err := e.ReadLine("> ")
+			if got != tt.want || err != nil {
+				t.Errorf("ReadLine = %q, %v, want %q", got, err, tt.want)
+			}
+			if listed := strings.Contains(out.String(), "\r\n"+tt.listed+"\r\n"); tt.listed != "" && !listed {
+				t.Errorf("output %q does not list %q", out.String(), tt.listed)
+			}
+		})
+	}
+}
+
+// interruptHook interrupts the machine when the function name is applied.
+type interruptHook struct {
+	BaseHook
+	m    *Machine
+	name string
+}
+
+func (h *interruptHook) Apply(f, name, args int) {
+	if name != Nil && h.m.NameString(name) == h.name {
+		h.m.Interrupt()
+	}
+}
+
+func TestREPLInterrupt(t *testing.T) {
+	t.Setenv("LISP_HISTORY", filepath.Join(t.TempDir(), "history"))
+	in, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	go func() {
+		w.WriteString("define x 5\ndefine (f x) (g x)\ndefine (g y) y\n(f 6)\nx\n(g 7)\n")
+		w.Close()
+	}()
+	var out bytes.Buffer
+	m := NewMachine(strings.NewReader(""), io.Discard)
+	m.AddHook(&interruptHook{m: m, name: "g"})
+	if err := m.RunREPL(in, &out); err != nil {
+		t.Fatalf("RunREPL: %v", err)
+	}
+	// The interrupt abandons (f 6), with x bound to 6; x is 5 again after
+	// it, and the next form is read and interrupted in turn.
+	want := "expression  (f 6)\ninterrupted\n" +
+		"lisp> expression  x\nvalue       5\n" +
+		"lisp> expression  (g 7)\ninterrupted\n" +
+		"lisp> End of LISP Run\n"
+	if got := out.String(); !strings.Contains(got, want) {
+		t.Errorf("output %q does not contain %q", got, want)
+	}
+	if len(m.Stack) != 0 || m.EvalDepth != 0 {
+		t.Errorf("after the interrupts: %d frames, EvalDepth %d", len(m.Stack), m.EvalDepth)
+	}
+}
+
+func TestREPLKeepsWrappers(t *testing.T) {
+	t.Setenv("LISP_HISTORY", filepath.Join(t.TempDir(), "history"))
+	in, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	go func() {
+		w.WriteString("car '(a b)\n")
+		w.Close()
+	}()
+	var out, costs bytes.Buffer
+	m := NewMachine(strings.NewReader(""), io.Discard)
+	// As main wraps them for -summary stderr -stats -stats-sort evals.
+	m.Out = &statsOutput{Output: &noSummaryOutput{m.Out}, m: m, footer: true, sortBy: "evals", w: &costs}
+	if err := m.RunREPL(in, &out); err != nil {
+		t.Fatalf("RunREPL: %v", err)
+	}
+	got := out.String()
+	if !strings.Contains(got, "value       a\ncost        ") {
+		t.Errorf("output %q has no cost record after the value", got)
+	}
+	if strings.Contains(got, "End of LISP Run") || strings.Contains(got, "car '(a b)") {
+		t.Errorf("output %q has the totals or the echo of the classic transcript", got)
+	}
+	if !strings.HasPrefix(costs.String(), "Costliest forms by evals:") {
+		t.Errorf("costs %q, want the costliest forms", costs.String())
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// --- Message Framing ---
+
+// The Debug Adapter and Language Server Protocols send JSON messages, each
+// after a header of "Name: value" lines ended by a blank line, of which
+// only Content-Length, the length of the message, matters.
+
+// readMessage reads a message from r and decodes it into v. It returns
+// io.EOF when r ends before a message starts.
+func readMessage(r *bufio.Reader, v any) error {
+	n := -1
+	for first := true; ; first = false {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && first && line == "" {
+			return io.EOF
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("bad header line %q", line)
+		}
+		if strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			if n, err = strconv.Atoi(strings.TrimSpace(value)); err != nil || n < 0 {
+				return fmt.Errorf("bad Content-Length %q", value)
+			}
+		}
+	}
+	if n < 0 {
+		return errors.New("no Content-Length")
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// writeMessage encodes v and writes it to w as a message.
+func writeMessage(w io.Writer, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
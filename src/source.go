@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// --- Source Positions ---
+
+// Token is a word of a source file as InWord2 sees it, together with where it
+// was found. Off and End are byte offsets; Line and Col are 1-based, with Col
+// counting bytes.
+type Token struct {
+	Text      string
+	Off, End  int
+	Line, Col int
+}
+
+// ScanTokens splits src into words with the same rules tokenizeLine applies
+// to M-expression input, including the brackets of comments.
+func ScanTokens(src []byte) []Token {
+	var tokens []Token
+	line, lineStart := 1, 0
+	multiByte := utf8Bytes(src)
+	var word []byte
+	start := -1
+	flush := func(end int) {
+		if start >= 0 && len(word) > 0 {
+			tokens = append(tokens, Token{string(word), start, end, line, start - lineStart + 1})
+		}
+		word = word[:0]
+		start = -1
+	}
+	for i := 0; i < len(src); i++ {
+		character := int(src[i])
+		if isSeparator(character, true) {
+			flush(i)
+			if !isSpace(character) {
+				tokens = append(tokens, Token{string(src[i]), i, i + 1, line, i - lineStart + 1})
+			}
+		} else if isPrintable(character) || multiByte[i] {
+			if start < 0 {
+				start = i
+			}
+			word = append(word, src[i])
+		}
+		if character == '\n' {
+			line, lineStart = line+1, i+1
+		}
+	}
+	flush(len(src))
+	return tokens
+}
+
+// Comment is the raw text of a bracketed comment, brackets included.
+type Comment struct {
+	Token
+	EndLine     int
+	BlankBefore bool // an empty line separates it from what came before
+	OwnLine     bool // what follows it starts on a later line
+}
+
+// Word is a token the reader sees, with the comments around it.
+type Word struct {
+	Token
+	BlankBefore bool
+	Lead        []Comment // comments between the previous word and this one
+	Trail       []Comment // comments on the same line, after this word
+}
+
+// SourceFile is a source file split into the words the reader sees, with
+// comments attached to the nearest word.
+type SourceFile struct {
+	Src     []byte
+	Words   []*Word
+	Trailer []Comment // comments after the last word
+}
+
+// SyntaxError reports input the reader cannot read to the end.
+type SyntaxError struct {
+	Line, Col int
+	Msg       string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Col, e.Msg)
+}
+
+// ParseSource groups the tokens of src into words and comments. Comments nest
+// as they do for InWord; an unterminated comment is a SyntaxError.
+func ParseSource(src []byte) (*SourceFile, error) {
+	tokens := ScanTokens(src)
+	f := &SourceFile{Src: src}
+	var pending []Comment
+	var prev *Word
+	prevEnd := 0
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.Text == "[" {
+			depth := 0
+			j := i
+			for ; j < len(tokens); j++ {
+				if tokens[j].Text == "[" {
+					depth++
+				} else if tokens[j].Text == "]" {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if j == len(tokens) {
+				return nil, &SyntaxError{t.Line, t.Col, "comment is not closed"}
+			}
+			c := Comment{Token: Token{string(src[t.Off:tokens[j].End]), t.Off, tokens[j].End, t.Line, t.Col}}
+			c.EndLine = tokens[j].Line
+			c.BlankBefore = blankLineBetween(src, prevEnd, t.Off)
+			if len(pending) > 0 {
+				pending[len(pending)-1].OwnLine = c.Line > pending[len(pending)-1].EndLine
+			}
+			pending = append(pending, c)
+			prevEnd = c.End
+			i = j
+			continue
+		}
+		w := &Word{Token: t}
+		if len(pending) > 0 {
+			pending[len(pending)-1].OwnLine = t.Line > pending[len(pending)-1].EndLine
+		}
+		w.Lead = attachTrail(prev, pending)
+		if len(w.Lead) > 0 {
+			w.BlankBefore = w.Lead[0].BlankBefore
+			w.Lead[0].BlankBefore = false
+		} else {
+			w.BlankBefore = blankLineBetween(src, prevEnd, t.Off)
+		}
+		pending = nil
+		f.Words = append(f.Words, w)
+		prev = w
+		prevEnd = t.End
+	}
+	if len(pending) > 0 {
+		pending[len(pending)-1].OwnLine = true
+	}
+	f.Trailer = attachTrail(prev, pending)
+	return f, nil
+}
+
+// attachTrail moves the comments that start on the line where prev ends to
+// prev, and returns the rest.
+func attachTrail(prev *Word, comments []Comment) []Comment {
+	if prev == nil {
+		return comments
+	}
+	n := 0
+	for n < len(comments) && comments[n].Line == prev.Line {
+		n++
+	}
+	prev.Trail = append(prev.Trail, comments[:n]...)
+	return comments[n:]
+}
+
+// blankLineBetween reports whether src[from:to] contains a line holding
+// nothing but white space.
+func blankLineBetween(src []byte, from, to int) bool {
+	newlines := 0
+	for i := from; i < to; i++ {
+		if src[i] == '\n' {
+			newlines++
+		}
+	}
+	return newlines >= 2
+}
+
+// sourcePos returns the 1-based line and column of offset off in src.
+func sourcePos(src []byte, off int) (line, col int) {
+	lineStart := 0
+	line = 1
+	for i := 0; i < off && i < len(src); i++ {
+		if src[i] == '\n' {
+			line, lineStart = line+1, i+1
+		}
+	}
+	return line, off - lineStart + 1
+}
+
+// SourceLine returns the 1-based line of Source that offset off is on.
+func (m *Machine) SourceLine(off int) int {
+	for ; m.scanned < len(m.Source); m.scanned++ {
+		if m.Source[m.scanned] == '\n' {
+			m.newlines = append(m.newlines, m.scanned)
+		}
+	}
+	return sort.SearchInts(m.newlines, off) + 1
+}
+
+// ExprLine returns the line of Source that the list e starts on, if it was
+// read from Source while Positions was set.
+func (m *Machine) ExprLine(e int) (int, bool) {
+	off, ok := m.Positions[e]
+	if !ok {
+		return 0, false
+	}
+	return m.SourceLine(off), true
+}
+
+func textWidth(s string) int {
+	return utf8.RuneCountInString(s)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// --- Backtraces ---
+
+// Frame is an application of a lambda in progress.
+type Frame struct {
+	Name  int // the symbol the lambda was the value of, or Nil
+	Func  int // the lambda
+	Args  int // the evaluated arguments
+	Depth int // the EvalDepth of the application
+}
+
+// A backtrace shows the innermost backtraceFrames frames, each shortened to
+// backtraceWidth characters.
+const (
+	backtraceFrames = 20
+	backtraceWidth  = 100
+)
+
+// FrameString returns a frame as the call it is, with the evaluated
+// arguments.
+func (m *Machine) FrameString(f Frame) string {
+	var b strings.Builder
+	if f.Name != Nil {
+		b.WriteString("(" + m.NameString(f.Name))
+	} else {
+		b.WriteString("(" + m.SexpString(f.Func))
+	}
+	for args := f.Args; !m.IsAtom(args); args = m.Cdr(args) {
+		b.WriteString(" " + m.SexpString(m.Car(args)))
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// noteFailure keeps a copy of Stack as the backtrace of a failure leaving
+// its innermost frame, unless it has one already: the first frame a failure
+// leaves is the one it happened in.
+func (m *Machine) noteFailure() {
+	if m.Backtraces && m.failure == nil {
+		m.failure = append([]Frame{}, m.Stack...)
+	}
+}
+
+// reportFailure writes the backtrace of the failure v, caught by try or at
+// top level, to ErrWriter, after a "| " for each try it happened in.
+func (m *Machine) reportFailure(v, tryDepth int) {
+	if !m.Backtraces {
+		return
+	}
+	if m.failure != nil {
+		prefix := strings.Repeat("| ", tryDepth)
+		fmt.Fprintf(m.ErrWriter, "%sbacktrace of %s:\n", prefix, m.SexpString(-v))
+		m.WriteBacktrace(m.ErrWriter, prefix, m.failure)
+	}
+	m.failure = nil
+}
+
+// WriteBacktrace writes frames to w, innermost first, one to a line after
+// prefix. Long backtraces leave out the outermost frames.
+func (m *Machine) WriteBacktrace(w io.Writer, prefix string, frames []Frame) {
+	for i := len(frames) - 1; i >= 0; i-- {
+		n := len(frames) - 1 - i
+		if n == backtraceFrames {
+			fmt.Fprintf(w, "%s  ... %d more\n", prefix, i+1)
+			break
+		}
+		fmt.Fprintf(w, "%s  #%d %s\n", prefix, n, shorten(m.FrameString(frames[i]), backtraceWidth))
+	}
+}
+
+// shorten returns s cut to width characters, ending with "..." if it was
+// longer.
+func shorten(s string, width int) string {
+	if textWidth(s) > width {
+		return string([]rune(s)[:width-3]) + "..."
+	}
+	return s
+}
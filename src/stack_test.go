@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBacktraces(t *testing.T) {
+	const readBit = "let (g x) read-bit let (f x) (g x) (f 3)"
+	frames := "" +
+		"  #0 (g 3)\n" +
+		"  #1 (f 3)\n" +
+		"  #2 ((lambda (f) (f 3)) (lambda (x) (g x)))\n" +
+		"  #3 ((lambda (g) ((' (lambda (f) (f 3))) (' (lambda (x) (g x))))) (lambda (x) (read-bit)))\n"
+	// prefixed returns the lines of s after prefix.
+	prefixed := func(prefix, s string) string {
+		return prefix + strings.ReplaceAll(strings.TrimSuffix(s, "\n"), "\n", "\n"+prefix) + "\n"
+	}
+	// innermost returns the frames a long backtrace shows, all of call.
+	innermost := func(call string) string {
+		var b strings.Builder
+		for i := range backtraceFrames {
+			fmt.Fprintf(&b, "  #%d %s\n", i, call)
+		}
+		return b.String()
+	}
+	list := "(" + strings.TrimSpace(strings.Repeat("a ", 60)) + ")"
+	tests := []struct {
+		name       string
+		src        string
+		backtraces bool
+		limit      int
+		heap       int
+		want       string
+	}{
+		{"caught by try", "try no-time-limit '" + readBit + " nil\n", true, 0, Size,
+			prefixed("| ", "backtrace of out-of-data:\n"+frames)},
+		{"nested try", "try no-time-limit 'try no-time-limit '" + readBit + " nil nil\n", true, 0, Size,
+			prefixed("| | ", "backtrace of out-of-data:\n"+frames)},
+		{"off", "try no-time-limit '" + readBit + " nil\n", false, 0, Size, ""},
+		{"success", "try no-time-limit 'let (f x) car x (f '(a)) nil\n", true, 0, Size, ""},
+		// Only the innermost frames are shown, each cut short.
+		{"time limit", "define (h x) (h x)\n(h '" + list + ")\n", true, 30, Size,
+			"backtrace of out-of-time:\n" + innermost(("(h " + list)[:backtraceWidth-3]+"...") + "  ... 11 more\n"},
+		// The backtrace of a storage overflow is written without
+		// Backtraces.
+		{"storage overflow", "define (f n) cons n (f n)\n(f 'a)\n", false, 0, 1000,
+			"backtrace of storage overflow:\n" + innermost("(f a)") + "  ... 251 more\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var errOut bytes.Buffer
+			m := NewMachine(strings.NewReader(tt.src), io.Discard)
+			m.ErrWriter = &errOut
+			m.Backtraces = tt.backtraces
+			m.TimeLimit = tt.limit
+			m.Nodes = make([]Node, tt.heap)
+			m.Run()
+			if got := errOut.String(); got != tt.want {
+				t.Errorf("backtrace\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Cost Statistics ---
+
+// formCost is the cost of a top-level form.
+type formCost struct {
+	Line          int
+	Title         string
+	Evals, Conses int
+	Time          time.Duration
+}
+
+// statsKeys order forms for the summary, costliest first.
+var statsKeys = map[string]func(a, b formCost) bool{
+	"order":  func(a, b formCost) bool { return a.Line < b.Line },
+	"evals":  func(a, b formCost) bool { return a.Evals > b.Evals },
+	"conses": func(a, b formCost) bool { return a.Conses > b.Conses },
+	"time":   func(a, b formCost) bool { return a.Time > b.Time },
+}
+
+// statsOutput adds the cost of each top-level form to another Output. With
+// footer set, a "cost" record follows the results of each form; with sortBy
+// set, a summary of the top forms ordered by that key is written to w at
+// the end of the run.
+type statsOutput struct {
+	Output
+	m      *Machine
+	footer bool
+	sortBy string
+	top    int
+	w      io.Writer
+
+	forms []formCost
+	line  int // the line of Source where off starts
+	off   int
+}
+
+func (o *statsOutput) EndForm(f *Form) {
+	if o.footer {
+		o.Output.Text("cost", fmt.Sprintf("%d evals, %d conses, %v", f.Evals, f.Conses, f.Time.Round(time.Microsecond)))
+	}
+	o.Output.EndForm(f)
+	if o.sortBy == "" {
+		return
+	}
+	m := o.m
+	if m.formStart >= o.off {
+		o.line += bytes.Count(m.Source[o.off:m.formStart], []byte("\n"))
+		o.off = m.formStart
+	}
+	o.forms = append(o.forms, formCost{o.line + 1, formTitle(f.Source), f.Evals, f.Conses, f.Time})
+}
+
+func (o *statsOutput) End(s *Summary) {
+	o.Output.End(s)
+	if o.sortBy == "" {
+		return
+	}
+	forms := append([]formCost(nil), o.forms...)
+	sort.SliceStable(forms, func(i, j int) bool { return statsKeys[o.sortBy](forms[i], forms[j]) })
+	if o.top > 0 && len(forms) > o.top {
+		forms = forms[:o.top]
+	}
+	var total time.Duration
+	for _, f := range o.forms {
+		total += f.Time
+	}
+	fmt.Fprintf(o.w, "Costliest forms by %s:\n", o.sortBy)
+	fmt.Fprintf(o.w, "%6s %10s %10s %12s  %s\n", "line", "evals", "conses", "time", "form")
+	for _, f := range forms {
+		fmt.Fprintf(o.w, "%6d %10d %10d %12v  %s\n", f.Line, f.Evals, f.Conses, f.Time.Round(time.Microsecond), f.Title)
+	}
+	fmt.Fprintf(o.w, "%6s %10d %10d %12v  %d forms\n", "total", s.Evals, s.Conses, total.Round(time.Microsecond), len(o.forms))
+}
+
+// formTitle returns the source of a form on one line, shortened to fit a
+// line of the summary.
+func formTitle(source string) string {
+	title := strings.Join(strings.Fields(source), " ")
+	if textWidth(title) > 40 {
+		title = string([]rune(title)[:37]) + "..."
+	}
+	return title
+}
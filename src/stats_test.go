@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// durations matches the times in the cost records and the summary, which
+// differ from run to run, with the spaces that align them.
+var durations = regexp.MustCompile(` +\d+(\.\d+)?(ns|µs|ms|s)\b`)
+
+func TestStats(t *testing.T) {
+	const src = "define (f x) cons x nil\n(f 'a)\ncar '(b)\n"
+	tests := []struct {
+		name   string
+		footer bool
+		sortBy string
+		top    int
+		// The records of the transcript, and what is written to w.
+		costs   string
+		summary string
+	}{
+		{"footer", true, "", 10,
+			"cost        0 evals, 70 conses, T\n" +
+				"cost        8 evals, 35 conses, T\n" +
+				"cost        4 evals, 36 conses, T\n",
+			""},
+		{"by evals", false, "evals", 10, "", "" +
+			"Costliest forms by evals:\n" +
+			"  line      evals     conses         time  form\n" +
+			"     2          8         35 T  (f 'a)\n" +
+			"     3          4         36 T  car '(b)\n" +
+			"     1          0         70 T  define (f x) cons x nil\n" +
+			" total         12        492 T  3 forms\n"},
+		{"top conses", false, "conses", 1, "", "" +
+			"Costliest forms by conses:\n" +
+			"  line      evals     conses         time  form\n" +
+			"     1          0         70 T  define (f x) cons x nil\n" +
+			" total         12        492 T  3 forms\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out, w bytes.Buffer
+			m := NewMachine(strings.NewReader(src), &out)
+			m.Out = &statsOutput{Output: m.Out, m: m, footer: tt.footer, sortBy: tt.sortBy, top: tt.top, w: &w}
+			if err := m.Run(); err != nil {
+				t.Fatal(err)
+			}
+			var costs strings.Builder
+			for _, l := range strings.SplitAfter(out.String(), "\n") {
+				if strings.HasPrefix(l, "cost ") {
+					costs.WriteString(l)
+				}
+			}
+			if got := durations.ReplaceAllString(costs.String(), " T"); got != tt.costs {
+				t.Errorf("cost records\n%s\nwant\n%s", got, tt.costs)
+			}
+			if got := durations.ReplaceAllString(w.String(), " T"); got != tt.summary {
+				t.Errorf("summary\n%s\nwant\n%s", got, tt.summary)
+			}
+		})
+	}
+}
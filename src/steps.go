@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"strings"
+)
+
+// --- Reduction Steps ---
+
+// Kinds of steps.
+const (
+	StepEval   = iota // Eval of Expr returned Value
+	StepBranch        // an if took its then branch, or its else branch
+	StepBind          // the lambda Func bound its parameters to Args
+	StepPrim          // the primitive Func applied to Args returned Value
+)
+
+// Step is a step of the evaluation of an expression. The steps of an Eval
+// are those it made before returning, in order.
+type Step struct {
+	Kind        int
+	Expr, Value int
+	Func, Args  int
+	Then        bool
+	Done        bool // Eval returned
+	Cut         bool // steps were left out here, after the Max of the stepper
+	Steps       []*Step
+}
+
+// Stepper records the steps of the evaluation of the top-level expression
+// that is on Line of Source: each call of Eval with the value it returned,
+// the choice of each if, the binding of the parameters of each lambda, and
+// the result of each primitive. The evaluations of numbers, nil and the
+// built-in symbols that evaluate to themselves are left out. After Max steps
+// it records no more, but still gives the values of the Evals it recorded.
+type Stepper struct {
+	BaseHook
+	m    *Machine
+	Line int
+	Max  int
+	Root *Step // the Eval of the expression, once it started
+
+	open  []*Step // the Evals in progress
+	steps int
+	skip  int  // the Evals in progress that are not recorded
+	cut   bool // steps were left out
+}
+
+// Stepper returns the stepper of m, and starts watching for the expression
+// on its Line.
+func (m *Machine) Stepper() *Stepper {
+	if m.stepper == nil {
+		m.stepper = &Stepper{m: m, Max: 1000}
+		m.AddHook(m.stepper)
+	}
+	return m.stepper
+}
+
+// add adds s to the steps of the innermost Eval in progress, unless Max
+// steps have been recorded.
+func (s *Stepper) add(st *Step) bool {
+	if len(s.open) == 0 {
+		return false
+	}
+	top := s.open[len(s.open)-1]
+	if s.skip > 0 || s.steps >= s.Max {
+		top.Cut = top.Cut || s.skip == 0
+		s.cut = true
+		return false
+	}
+	s.steps++
+	top.Steps = append(top.Steps, st)
+	return true
+}
+
+func (s *Stepper) Enter(e int) {
+	m := s.m
+	if m.EvalDepth == 1 && s.Root == nil && m.formStart >= 0 &&
+		m.SourceLine(m.formStart) <= s.Line && s.Line <= m.SourceLine(max(m.formEnd-1, m.formStart)) {
+		s.Root = &Step{Kind: StepEval, Expr: e}
+		s.open = []*Step{s.Root}
+		return
+	}
+	if len(s.open) == 0 {
+		return
+	}
+	if s.skip > 0 || m.IsNumber(e) || e == m.SymNil || m.IsAtom(e) && m.IsBuiltin(e) && m.Car(m.Value(e)) == e {
+		s.skip++
+		return
+	}
+	st := &Step{Kind: StepEval, Expr: e}
+	if !s.add(st) {
+		s.skip++
+		return
+	}
+	s.open = append(s.open, st)
+}
+
+func (s *Stepper) Leave(e, v int) {
+	if len(s.open) == 0 {
+		return
+	}
+	if s.skip > 0 {
+		s.skip--
+		return
+	}
+	st := s.open[len(s.open)-1]
+	s.open = s.open[:len(s.open)-1]
+	st.Value, st.Done = v, true
+}
+
+func (s *Stepper) Branch(e int, then bool) {
+	s.add(&Step{Kind: StepBranch, Expr: e, Then: then})
+}
+
+func (s *Stepper) Apply(f, name, args int) {
+	if m := s.m; !m.IsAtom(f) && m.Car(f) == m.SymLambda {
+		s.add(&Step{Kind: StepBind, Func: f, Args: args})
+	}
+}
+
+func (s *Stepper) Return(f, name, args, v int) {
+	if s.m.PrimCode(f) > PrimNone {
+		s.add(&Step{Kind: StepPrim, Func: f, Args: args, Value: v})
+	}
+}
+
+// stepWidth is the number of characters an expression or a value of a step
+// is shortened to.
+const stepWidth = 100
+
+// text returns st as a line of a trace, and the line that ends its steps if
+// it has any.
+func (s *Stepper) text(st *Step) (string, string) {
+	m := s.m
+	str := func(x int) string { return shorten(m.SexpString(x), stepWidth) }
+	value := func(v int) string {
+		switch {
+		case !st.Done && st.Kind == StepEval:
+			return "unfinished"
+		case v < 0:
+			return "failed: " + m.SexpString(-v)
+		}
+		return str(v)
+	}
+	switch st.Kind {
+	case StepBranch:
+		if st.Then {
+			return "if takes the then branch", ""
+		}
+		return "if takes the else branch", ""
+	case StepBind:
+		var b strings.Builder
+		b.WriteString("bind")
+		vars, args := m.Car(m.Cdr(st.Func)), st.Args
+		for i := 0; !m.IsAtom(vars); vars, args, i = m.Cdr(vars), m.Cdr(args), i+1 {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, " %s = %s", m.SexpString(m.Car(vars)), str(m.Car(args)))
+		}
+		return b.String(), ""
+	case StepPrim:
+		return fmt.Sprintf("%s = %s", shorten(m.FrameString(Frame{Name: st.Func, Args: st.Args}), stepWidth), value(st.Value)), ""
+	}
+	if len(st.Steps) == 0 && !st.Cut {
+		if !st.Done {
+			return str(st.Expr), ""
+		}
+		return fmt.Sprintf("%s = %s", str(st.Expr), value(st.Value)), ""
+	}
+	if !st.Done {
+		return str(st.Expr), "unfinished"
+	}
+	if st.Value < 0 {
+		return str(st.Expr), value(st.Value)
+	}
+	return str(st.Expr), "= " + value(st.Value)
+}
+
+// WriteText writes the steps to w as an indented trace: each Eval that made
+// steps is followed by them, indented, and then by its value.
+func (s *Stepper) WriteText(w io.Writer) {
+	var write func(st *Step, indent string)
+	write = func(st *Step, indent string) {
+		line, end := s.text(st)
+		fmt.Fprintf(w, "%s%s\n", indent, line)
+		for _, c := range st.Steps {
+			write(c, indent+"  ")
+		}
+		if st.Cut {
+			fmt.Fprintf(w, "%s  ...\n", indent)
+		}
+		if end != "" {
+			fmt.Fprintf(w, "%s%s\n", indent, end)
+		}
+	}
+	if s.Root != nil {
+		write(s.Root, "")
+	}
+	if s.cut {
+		fmt.Fprintf(w, "stopped recording after %d steps\n", s.Max)
+	}
+}
+
+const stepsStyle = `
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; padding: 0 1em; color: #222; }
+h1 { font-size: 1.4em; }
+code { font-family: monospace; font-size: 0.95em; }
+details, .step { margin-left: 1.2em; }
+summary { cursor: pointer; margin-left: -1.2em; }
+.value { color: #262; }
+.failed { color: #a22; }
+.note { color: #a60; }
+.cut { color: #888; }
+`
+
+// WriteHTML writes the steps to w as a self-contained HTML page, where each
+// Eval that made steps unfolds to show them.
+func (s *Stepper) WriteHTML(w io.Writer) {
+	m := s.m
+	title := fmt.Sprintf("Steps of line %d", s.Line)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n<style>%s</style>\n</head>\n<body>\n<h1>%s</h1>\n",
+		html.EscapeString(title), stepsStyle, html.EscapeString(title))
+	code := func(x int) string {
+		return "<code>" + html.EscapeString(m.SexpString(x)) + "</code>"
+	}
+	result := func(st *Step) string {
+		switch {
+		case !st.Done && st.Kind == StepEval:
+			return " <span class=\"cut\">unfinished</span>"
+		case st.Value < 0:
+			return " <span class=\"failed\">failed: " + html.EscapeString(m.SexpString(-st.Value)) + "</span>"
+		}
+		return " = <span class=\"value\">" + code(st.Value) + "</span>"
+	}
+	var write func(st *Step)
+	write = func(st *Step) {
+		if st.Kind != StepEval {
+			line, _ := s.text(st)
+			class := "note"
+			if st.Kind == StepPrim {
+				class = "prim"
+			}
+			fmt.Fprintf(w, "<div class=\"step %s\"><code>%s</code></div>\n", class, html.EscapeString(line))
+			return
+		}
+		if len(st.Steps) == 0 && !st.Cut {
+			fmt.Fprintf(w, "<div class=\"step\">%s%s</div>\n", code(st.Expr), result(st))
+			return
+		}
+		fmt.Fprintf(w, "<details open><summary>%s%s</summary>\n", code(st.Expr), result(st))
+		for _, c := range st.Steps {
+			write(c)
+		}
+		if st.Cut {
+			fmt.Fprintf(w, "<div class=\"step cut\">…</div>\n")
+		}
+		fmt.Fprintf(w, "</details>\n")
+	}
+	if s.Root != nil {
+		write(s.Root)
+	}
+	if s.cut {
+		fmt.Fprintf(w, "<p class=\"cut\">Stopped recording after %d steps.</p>\n", s.Max)
+	}
+	fmt.Fprintf(w, "</body>\n</html>\n")
+}
+
+// writeSteps writes the steps of the stepper of m to the file name as
+// HTML, or to standard error as text if name is empty.
+func writeSteps(m *Machine, name string) error {
+	s := m.Stepper()
+	if s.Root == nil {
+		return fmt.Errorf("line %d is not in a top-level expression", s.Line)
+	}
+	if name == "" {
+		s.WriteText(os.Stderr)
+		return nil
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	s.WriteHTML(f)
+	return f.Close()
+}
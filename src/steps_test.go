@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStepper(t *testing.T) {
+	const src = "define (f x) if atom x x car x\n(f '(a b))\n"
+	tests := []struct {
+		name       string
+		line, max  int
+		text, html string
+	}{
+		{
+			name: "all steps", line: 2, max: 1000,
+			text: "" +
+				"(f (' (a b)))\n" +
+				"  f = (lambda (x) (if (atom x) x (car x)))\n" +
+				"  (' (a b)) = (a b)\n" +
+				"  bind x = (a b)\n" +
+				"  (if (atom x) x (car x))\n" +
+				"    (atom x)\n" +
+				"      x = (a b)\n" +
+				"      (atom (a b)) = false\n" +
+				"    = false\n" +
+				"    if takes the else branch\n" +
+				"    (car x)\n" +
+				"      x = (a b)\n" +
+				"      (car (a b)) = a\n" +
+				"    = a\n" +
+				"  = a\n" +
+				"= a\n",
+		},
+		{
+			// After -steps-max steps the Evals in progress still get their
+			// values, and each marks where its steps were left out.
+			name: "cut", line: 2, max: 6,
+			text: "" +
+				"(f (' (a b)))\n" +
+				"  f = (lambda (x) (if (atom x) x (car x)))\n" +
+				"  (' (a b)) = (a b)\n" +
+				"  bind x = (a b)\n" +
+				"  (if (atom x) x (car x))\n" +
+				"    (atom x)\n" +
+				"      x = (a b)\n" +
+				"      ...\n" +
+				"    = false\n" +
+				"    ...\n" +
+				"  = a\n" +
+				"= a\n" +
+				"stopped recording after 6 steps\n",
+			html: "<h1>Steps of line 2</h1>\n" +
+				"<details open><summary><code>(f (&#39; (a b)))</code> = <span class=\"value\"><code>a</code></span></summary>\n" +
+				"<div class=\"step\"><code>f</code> = <span class=\"value\"><code>(lambda (x) (if (atom x) x (car x)))</code></span></div>\n" +
+				"<div class=\"step\"><code>(&#39; (a b))</code> = <span class=\"value\"><code>(a b)</code></span></div>\n" +
+				"<div class=\"step note\"><code>bind x = (a b)</code></div>\n" +
+				"<details open><summary><code>(if (atom x) x (car x))</code> = <span class=\"value\"><code>a</code></span></summary>\n" +
+				"<details open><summary><code>(atom x)</code> = <span class=\"value\"><code>false</code></span></summary>\n" +
+				"<div class=\"step\"><code>x</code> = <span class=\"value\"><code>(a b)</code></span></div>\n" +
+				"<div class=\"step cut\">…</div>\n" +
+				"</details>\n" +
+				"<div class=\"step cut\">…</div>\n" +
+				"</details>\n" +
+				"</details>\n" +
+				"<p class=\"cut\">Stopped recording after 6 steps.</p>\n" +
+				"</body>\n</html>\n",
+		},
+		{
+			name: "no steps", line: 3, max: 1000,
+			text: "",
+			html: "<h1>Steps of line 3</h1>\n</body>\n</html>\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMachine(strings.NewReader(src), io.Discard)
+			s := m.Stepper()
+			s.Line, s.Max = tt.line, tt.max
+			if err := m.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if (s.Root != nil) != (tt.text != "") {
+				t.Errorf("Root = %v", s.Root)
+			}
+			var text, page bytes.Buffer
+			s.WriteText(&text)
+			if text.String() != tt.text {
+				t.Errorf("text\n%s\nwant\n%s", text.String(), tt.text)
+			}
+			if tt.html == "" {
+				return
+			}
+			s.WriteHTML(&page)
+			_, body, _ := strings.Cut(page.String(), "</head>\n<body>\n")
+			if body != tt.html {
+				t.Errorf("HTML\n%s\nwant\n%s", body, tt.html)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+//go:build linux || darwin || ios || freebsd || openbsd || netbsd || dragonfly
+
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// --- Terminal Modes ---
+
+// termState is the mode of a terminal before makeRaw changed it.
+type termState struct {
+	termios syscall.Termios
+}
+
+// termiosRequests returns the ioctl requests that get and set the mode of a
+// terminal (TCGETS and TCSETS, or TIOCGETA and TIOCSETA), which differ
+// between systems.
+func termiosRequests() (get, set uintptr, ok bool) {
+	switch runtime.GOOS {
+	case "linux":
+		switch runtime.GOARCH {
+		case "mips", "mipsle", "mips64", "mips64le":
+			return 0x540d, 0x540e, true
+		case "ppc64", "ppc64le":
+			return 0x402c7413, 0x802c7414, true
+		}
+		return 0x5401, 0x5402, true
+	case "darwin", "ios":
+		return 0x40487413, 0x80487414, true
+	case "freebsd", "openbsd", "netbsd", "dragonfly":
+		return 0x402c7413, 0x802c7414, true
+	}
+	return 0, 0, false
+}
+
+// makeRaw puts the terminal f into raw mode for the line editor: input is
+// read a byte at a time without echo, and Ctrl-C, Ctrl-S and Ctrl-Q are
+// read as bytes rather than acted on. Output is processed as before, so
+// that a newline still starts a new line.
+func makeRaw(f *os.File) (*termState, error) {
+	get, set, ok := termiosRequests()
+	if !ok {
+		return nil, errors.New("raw mode is not supported on " + runtime.GOOS)
+	}
+	var t syscall.Termios
+	if err := ioctlTermios(f, get, &t); err != nil {
+		return nil, err
+	}
+	old := &termState{t}
+	t.Iflag &^= syscall.IXON | syscall.ICRNL
+	t.Lflag &^= syscall.ICANON | syscall.ECHO | syscall.ISIG
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := ioctlTermios(f, set, &t); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// restoreTerm puts the terminal f back into the mode s.
+func restoreTerm(f *os.File, s *termState) error {
+	_, set, _ := termiosRequests()
+	return ioctlTermios(f, set, &s.termios)
+}
+
+func ioctlTermios(f *os.File, req uintptr, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !(linux || darwin || ios || freebsd || openbsd || netbsd || dragonfly)
+
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+)
+
+// --- Terminal Modes ---
+
+// termState is the mode of a terminal before makeRaw changed it.
+type termState struct{}
+
+// makeRaw fails where raw mode is not supported, and the line editor reads
+// lines as they are.
+func makeRaw(f *os.File) (*termState, error) {
+	return nil, errors.New("raw mode is not supported on " + runtime.GOOS)
+}
+
+// restoreTerm puts the terminal f back into the mode s.
+func restoreTerm(f *os.File, s *termState) error {
+	return nil
+}
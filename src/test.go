@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// --- Golden Tests ---
+
+// testDirs are the directories "lisp test" runs by default.
+var testDirs = []string{"ait", "lm", "unknowable", "examples", "tests"}
+
+// testResult is the outcome of running one .l file.
+type testResult struct {
+	name     string // the .l file
+	golden   string // its .r transcript
+	skipped  bool   // there is no transcript to compare with
+	updated  bool
+	err      error
+	failures []string
+}
+
+// RunTranscript runs the program src on a new machine and returns its
+// classic transcript.
+func RunTranscript(src []byte) []byte {
+	var out bytes.Buffer
+	m := NewMachine(bytes.NewReader(src), &out)
+	m.Run()
+	return out.Bytes()
+}
+
+// CompareTranscripts compares the transcript got with the transcript want,
+// form by form, and describes each form whose records differ. With semantic
+// set, only the words of the source and the labels and S-expressions of the
+// records are compared, so that wrapping and spacing do not matter, nor do
+// the totals at the end, which differ between implementations.
+func CompareTranscripts(name string, want, got []byte, semantic bool) []string {
+	w, g := ParseTranscript(want), ParseTranscript(got)
+	var failures []string
+	report := func(line int, title string, d []string) {
+		s := fmt.Sprintf("%s:%d: %s", name, line, title)
+		for _, l := range d {
+			s += "\n    " + l
+		}
+		failures = append(failures, s)
+	}
+	// A form the transcript lacks is reported where its trailer starts.
+	end := len(bytes.Split(want, []byte("\n"))) - len(w.Trailer)
+	for i := 0; i < max(len(w.Forms), len(g.Forms)); i++ {
+		switch {
+		case i >= len(g.Forms):
+			report(w.Forms[i].Line, w.Forms[i].Title(), []string{"- form missing from the output"})
+		case i >= len(w.Forms):
+			report(end, g.Forms[i].Title(), []string{"+ form not in the transcript"})
+		default:
+			wf, gf := w.Forms[i], g.Forms[i]
+			var d []string
+			if semantic {
+				d = diffLines(semanticLines(wf), semanticLines(gf))
+			} else {
+				d = append(diffLines(wf.Echo, gf.Echo), diffLines(wf.RecordLines, gf.RecordLines)...)
+			}
+			if len(d) > 0 {
+				title := wf.Title()
+				if title == "" {
+					title = gf.Title()
+				}
+				report(wf.Line, title, d)
+			}
+		}
+	}
+	if d := diffLines(w.Header, g.Header); len(d) > 0 {
+		report(1, "header", d)
+	}
+	if d := diffLines(w.Trailer, g.Trailer); len(d) > 0 && !semantic {
+		report(end, "end of run", d)
+	}
+	return failures
+}
+
+// semanticLines describes a form by its source words and its records, with
+// the values in NormalSexp form.
+func semanticLines(f *TranscriptForm) []string {
+	lines := []string{"source " + f.Source()}
+	for _, r := range f.Records {
+		lines = append(lines, fmt.Sprintf("%-11s %s", r.Label, NormalSexp(r.Value)))
+	}
+	return lines
+}
+
+func runTest(name string, update, semantic bool) testResult {
+	r := testResult{name: name, golden: name[:len(name)-len(".l")] + ".r"}
+	src, err := os.ReadFile(name)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	want, err := os.ReadFile(r.golden)
+	if err != nil && !os.IsNotExist(err) {
+		r.err = err
+		return r
+	}
+	if err != nil && !update {
+		r.skipped = true
+		return r
+	}
+	got := RunTranscript(src)
+	if update {
+		if !bytes.Equal(want, got) {
+			r.err = os.WriteFile(r.golden, got, 0666)
+			r.updated = true
+		}
+		return r
+	}
+	if !bytes.Equal(want, got) {
+		r.failures = CompareTranscripts(r.golden, want, got, semantic)
+		if len(r.failures) == 0 && !semantic {
+			r.failures = []string{r.golden + ": output differs in white space"}
+		}
+	}
+	return r
+}
+
+// testMain implements "lisp test".
+func testMain(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	update := flags.Bool("update", false, "write the transcripts instead of comparing with them")
+	jobs := flags.Int("j", runtime.NumCPU(), "run `n` files at the same time")
+	semantic := flags.Bool("semantic", false, "compare only the source words and the S-expressions of the records")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: lisp test [-update] [-semantic] [-j n] [dir ...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	dirs := flags.Args()
+	if len(dirs) == 0 {
+		dirs = testDirs
+	}
+	var names []string
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitUsage
+		}
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.l"))
+		names = append(names, matches...)
+	}
+
+	results := make([]testResult, len(names))
+	sem := make(chan struct{}, max(*jobs, 1))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = runTest(name, *update, *semantic)
+		}()
+	}
+	wg.Wait()
+
+	status := ExitSuccess
+	passed, failed, skipped := 0, 0, 0
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			fmt.Printf("FAIL %s: %v\n", r.name, r.err)
+			failed++
+			status = ExitFindings
+		case r.skipped:
+			fmt.Printf("skip %s: no %s\n", r.name, r.golden)
+			skipped++
+		case r.updated:
+			fmt.Printf("wrote %s\n", r.golden)
+			passed++
+		case len(r.failures) > 0:
+			fmt.Printf("FAIL %s\n", r.name)
+			for _, f := range r.failures {
+				fmt.Println(f)
+			}
+			failed++
+			status = ExitFindings
+		default:
+			passed++
+		}
+	}
+	if *update {
+		fmt.Printf("%d files, %d failed\n", passed+failed, failed)
+	} else {
+		fmt.Printf("%d passed, %d failed, %d skipped\n", passed, failed, skipped)
+	}
+	return status
+}
+
+// compareMain implements "lisp compare".
+func compareMain(args []string) int {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	semantic := flags.Bool("semantic", false, "compare only the source words and the S-expressions of the records")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: lisp compare [-semantic] want.r got.r\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return ExitUsage
+	}
+	want, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+	got, err := os.ReadFile(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+	if bytes.Equal(want, got) {
+		return ExitSuccess
+	}
+	failures := CompareTranscripts(flags.Arg(0), want, got, *semantic)
+	if len(failures) == 0 && !*semantic {
+		failures = []string{flags.Arg(1) + ": output differs in white space"}
+	}
+	for _, f := range failures {
+		fmt.Println(f)
+	}
+	if len(failures) > 0 {
+		return ExitFindings
+	}
+	return ExitSuccess
+}
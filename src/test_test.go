@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompareTranscripts(t *testing.T) {
+	want := sampleTranscript
+	tests := []struct {
+		name     string
+		got      string
+		semantic bool
+		failures []string
+	}{
+		{"same", want, false, nil},
+		{"value", strings.Replace(want, "value       a\n", "value       b\n", 1), false, []string{
+			"t.r:16: expression (display (' a))\n    - value       a\n    + value       b",
+		}},
+		{"missing form", strings.Replace(want, "display 'a\n\nexpression  (display (' a))\ndisplay     a\nvalue       a\n\n", "", 1), false, []string{
+			"t.r:16: expression (display (' a))\n    - form missing from the output",
+		}},
+		{"extra form", strings.Replace(want, "End of LISP Run", "x\n\nexpression  x\nvalue       x\n\nEnd of LISP Run", 1), false, []string{
+			"t.r:23: expression x\n    + form not in the transcript",
+		}},
+		{"totals", strings.Replace(want, "= 729", "= 730", 1), false, []string{
+			"t.r:23: end of run\n    - Calls to cons = 729\n    + Calls to cons = 730",
+		}},
+		{"totals semantic", strings.Replace(want, "= 729", "= 730", 1), true, nil},
+		{"wrapping semantic", strings.Replace(want, "v\n             w x y z)))", "v w x y z)))", 1), true, nil},
+		{"wrapping", strings.Replace(want, "v\n             w x y z)))", "v w x y z)))", 1), false, []string{
+			"t.r:9: expression (f (' (a b c d e f g h i j k l m n o p q r s t u v w x y z)))\n" +
+				"    - expression  (f (' (a b c d e f g h i j k l m n o p q r s t u v\n" +
+				"    -              w x y z)))\n" +
+				"    + expression  (f (' (a b c d e f g h i j k l m n o p q r s t u v w x y z)))",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CompareTranscripts("t.r", []byte(want), []byte(tt.got), tt.semantic)
+			if strings.Join(got, "\n") != strings.Join(tt.failures, "\n") {
+				t.Errorf("got failures\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.failures, "\n"))
+			}
+		})
+	}
+}
+
+// TestTranscripts runs the programs of the repository that have a
+// transcript, as "lisp test" does.
+func TestTranscripts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs every program")
+	}
+	for _, dir := range testDirs {
+		names, _ := filepath.Glob(filepath.Join("..", dir, "*.l"))
+		for _, name := range names {
+			want, err := os.ReadFile(strings.TrimSuffix(name, ".l") + ".r")
+			if err != nil {
+				continue
+			}
+			src, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range CompareTranscripts(name, want, RunTranscript(src), false) {
+				t.Error(f)
+			}
+		}
+	}
+}
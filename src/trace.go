@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// --- Tracing ---
+
+// Tracer prints each application of a traced function: a lambda that is the
+// value of a named symbol. The call is printed with its evaluated arguments
+// as it starts, and the function's name with the value it returned as it
+// ends. Lines are indented by the number of traced calls in progress, after
+// a "| " for each try they happen in. Trace output goes to W rather than
+// through display, so try never captures it.
+type Tracer struct {
+	BaseHook
+	m     *Machine
+	W     io.Writer
+	All   bool            // trace every named function
+	Names map[string]bool // the functions to trace when All is not set
+
+	depth int
+}
+
+// Tracer returns the tracer of m, which starts out tracing nothing and
+// writes to the ErrWriter of m.
+func (m *Machine) Tracer() *Tracer {
+	if m.tracer == nil {
+		m.tracer = &Tracer{m: m, W: m.ErrWriter, Names: map[string]bool{}}
+		m.AddHook(m.tracer)
+	}
+	return m.tracer
+}
+
+// Trace starts or stops tracing the function named by the symbol name.
+func (m *Machine) Trace(name int, on bool) {
+	t := m.Tracer()
+	if on {
+		t.Names[m.NameString(name)] = true
+	} else {
+		delete(t.Names, m.NameString(name))
+	}
+}
+
+func (t *Tracer) traced(f, name int) bool {
+	m := t.m
+	return name != Nil && !m.IsAtom(f) && m.Car(f) == m.SymLambda &&
+		(t.All || t.Names[m.NameString(name)])
+}
+
+func (t *Tracer) line(text string) {
+	prefix := strings.Repeat("| ", t.m.TryDepth) + strings.Repeat("  ", t.depth)
+	fmt.Fprintf(t.W, "%s%s\n", prefix, text)
+}
+
+func (t *Tracer) Enter(e int) {
+	if t.m.EvalDepth == 1 {
+		// A new top-level expression: forget calls that a failure of the
+		// last one left unfinished.
+		t.depth = 0
+	}
+}
+
+func (t *Tracer) Apply(f, name, args int) {
+	if !t.traced(f, name) {
+		return
+	}
+	m := t.m
+	var b strings.Builder
+	b.WriteString("(" + m.NameString(name))
+	for ; !m.IsAtom(args); args = m.Cdr(args) {
+		b.WriteString(" " + m.SexpString(m.Car(args)))
+	}
+	b.WriteString(")")
+	t.line(b.String())
+	t.depth++
+}
+
+func (t *Tracer) Return(f, name, args, v int) {
+	if !t.traced(f, name) {
+		return
+	}
+	m := t.m
+	t.depth--
+	if v < 0 {
+		t.line(fmt.Sprintf("%s failed: %s", m.NameString(name), m.SexpString(-v)))
+		return
+	}
+	t.line(fmt.Sprintf("%s = %s", m.NameString(name), m.SexpString(v)))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	const calls = "define (g x) cons x nil\ndefine (f x) (g x)\n(f 'a)\ntrace f\n(f 'b)\nuntrace f\n(f 'c)\n"
+	tests := []struct {
+		name  string
+		src   string
+		names []string // traced from the start, or all for "*"
+		limit int      // the TimeLimit of top-level expressions
+		want  string
+	}{
+		{"commands", calls, []string{"g"}, 0, "" +
+			"(g a)\ng = (a)\n" +
+			"(f b)\n  (g b)\n  g = (b)\nf = (b)\n" +
+			"(g c)\ng = (c)\n"},
+		{"all", calls, []string{"*"}, 0, "" +
+			"(f a)\n  (g a)\n  g = (a)\nf = (a)\n" +
+			"(f b)\n  (g b)\n  g = (b)\nf = (b)\n" +
+			"(f c)\n  (g c)\n  g = (c)\nf = (c)\n"},
+		{"failures in try", "trace f\ntry 3 'let (f x) if atom x x (f car x) (f '((((a))))) nil\n", nil, 0, "" +
+			"| (f ((((a)))))\n" +
+			"|   (f (((a))))\n" +
+			"|     (f ((a)))\n" +
+			"|     f failed: out-of-time\n" +
+			"|   f failed: out-of-time\n" +
+			"| f failed: out-of-time\n"},
+		// Under a time limit a top-level expression fails with no try.
+		{"time limit", "define (f x) (g x)\ndefine (g x) (f x)\n(f 'a)\n", []string{"f", "g"}, 2, "" +
+			"(f a)\n" +
+			"  (g a)\n" +
+			"    (f a)\n" +
+			"    f failed: out-of-time\n" +
+			"  g failed: out-of-time\n" +
+			"f failed: out-of-time\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out, trace bytes.Buffer
+			m := NewMachine(strings.NewReader(tt.src), &out)
+			m.ErrWriter = &trace
+			m.TimeLimit = tt.limit
+			for _, name := range tt.names {
+				if name == "*" {
+					m.Tracer().All = true
+				} else {
+					m.Tracer().Names[name] = true
+				}
+			}
+			if err := m.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if trace.String() != tt.want {
+				t.Errorf("trace\n%s\nwant\n%s", trace.String(), tt.want)
+			}
+			if strings.Contains(out.String(), "= (") || strings.Contains(out.String(), "failed") {
+				t.Errorf("transcript %q has the trace", out.String())
+			}
+		})
+	}
+}
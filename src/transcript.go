@@ -0,0 +1,208 @@
+package main
+
+import (
+	"strings"
+)
+
+// --- Reading Transcripts ---
+
+// transcriptLabels are the labels a classic transcript puts before records.
+var transcriptLabels = map[string]bool{
+	"expression": true,
+	"value":      true,
+	"define":     true,
+	"display":    true,
+	"debug":      true,
+	"arity":      true,
+	"doc":        true,
+	"comment":    true,
+	"trace":      true,
+	"untrace":    true,
+	"break":      true,
+	"unbreak":    true,
+	"heap":       true,
+	"memory":     true,
+}
+
+// TranscriptForm is the part of a classic transcript written for one
+// top-level form: the echo of its source, and its records.
+type TranscriptForm struct {
+	Line        int // the line of the transcript where the form begins
+	Echo        []string
+	Records     []Record
+	RecordLines []string // the lines of the records as written
+}
+
+// Record is a labelled result in a transcript. The continuation lines of a
+// wrapped value are joined to the first, so Value is the value as it would
+// be printed without wrapping.
+type Record struct {
+	Line  int
+	Label string
+	Value string
+}
+
+// Transcript is a classic transcript split into forms.
+type Transcript struct {
+	Header  []string
+	Forms   []*TranscriptForm
+	Trailer []string // "End of LISP Run" and the totals
+}
+
+// ParseTranscript splits a transcript written with padded labels into its
+// forms. A form starts with the first echoed line after the records of the
+// previous one; the records are the lines that start with a label, and the
+// continuation lines of wrapped values. The blank line written before the
+// end of the input was found is not a form.
+func ParseTranscript(data []byte) *Transcript {
+	lines := strings.Split(string(data), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	t := &Transcript{}
+	i := 0
+	if len(lines) > 0 && lines[0] == "LISP Interpreter Run" {
+		t.Header = lines[:1]
+		i = 1
+	}
+	var f *TranscriptForm
+	inRecords := false
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if line == "End of LISP Run" {
+			if f != nil && !inRecords && strings.TrimSpace(strings.Join(f.Echo, "")) == "" {
+				t.Forms = t.Forms[:len(t.Forms)-1]
+			}
+			t.Trailer = lines[i:]
+			break
+		}
+		switch {
+		case f != nil && isRecordLine(line):
+			label, _, _ := strings.Cut(line, " ")
+			f.Records = append(f.Records, Record{i + 1, label, line[12:]})
+			f.RecordLines = append(f.RecordLines, line)
+			inRecords = true
+		case inRecords && isContinuationLine(line):
+			f.Records[len(f.Records)-1].Value += line[12:]
+			f.RecordLines = append(f.RecordLines, line)
+		default:
+			if f == nil || inRecords {
+				f = &TranscriptForm{Line: i + 1}
+				t.Forms = append(t.Forms, f)
+				inRecords = false
+			}
+			f.Echo = append(f.Echo, line)
+		}
+	}
+	return t
+}
+
+// isRecordLine reports whether line starts with a label padded to 12
+// columns.
+func isRecordLine(line string) bool {
+	label, _, _ := strings.Cut(line, " ")
+	return transcriptLabels[label] && len(line) > 12 &&
+		strings.TrimSpace(line[len(label):12]) == "" && line[12] != ' '
+}
+
+// isContinuationLine reports whether line continues a wrapped value. A value
+// may wrap just before a blank, so the continuation can start with one.
+func isContinuationLine(line string) bool {
+	return len(line) > 12 && strings.TrimSpace(line[:12]) == ""
+}
+
+// Source returns the echoed source of the form, with the white space
+// between its words made single blanks.
+func (f *TranscriptForm) Source() string {
+	return strings.Join(strings.Fields(strings.Join(f.Echo, " ")), " ")
+}
+
+// Title returns the expression or definition of the form, or else the
+// first line of its source.
+func (f *TranscriptForm) Title() string {
+	for _, r := range f.Records {
+		if r.Label == "expression" || r.Label == "define" {
+			return r.Label + " " + r.Value
+		}
+	}
+	for _, line := range f.Echo {
+		if s := strings.TrimSpace(line); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// NormalSexp returns the S-expression s printed with single blanks between
+// its elements, so that two printings of the same S-expression give the same
+// string however they were wrapped or spaced.
+func NormalSexp(s string) string {
+	var b strings.Builder
+	prev := byte('(')
+	word := -1
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && s[i] != '(' && s[i] != ')' && !isSpace(int(s[i])) {
+			if word < 0 {
+				word = i
+			}
+			continue
+		}
+		if word >= 0 {
+			if prev != '(' {
+				b.WriteByte(' ')
+			}
+			b.WriteString(s[word:i])
+			prev, word = s[i-1], -1
+		}
+		if i < len(s) && (s[i] == '(' || s[i] == ')') {
+			if s[i] == '(' && prev != '(' {
+				b.WriteByte(' ')
+			}
+			b.WriteByte(s[i])
+			prev = s[i]
+		}
+	}
+	return b.String()
+}
+
+// SameSexp reports whether a and b are printings of the same S-expression.
+func SameSexp(a, b string) bool {
+	return NormalSexp(a) == NormalSexp(b)
+}
+
+// diffLines returns the lines of a that are not in b prefixed by "- ", and
+// the lines of b that are not in a prefixed by "+ ", in order, following
+// a longest common subsequence of the two.
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var d []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			d = append(d, "- "+a[i])
+			i++
+		default:
+			d = append(d, "+ "+b[j])
+			j++
+		}
+	}
+	return d
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const sampleTranscript = `LISP Interpreter Run
+
+[ a comment ]
+define (f x)
+   cons x nil
+
+define      f
+value       (lambda (x) (cons x nil))
+
+(f '(a b c d e f g h i j k l m n o p q r s t u v w x y z))
+
+expression  (f (' (a b c d e f g h i j k l m n o p q r s t u v
+             w x y z)))
+value       ((a b c d e f g h i j k l m n o p q r s t u v w x 
+            y z))
+
+display 'a
+
+expression  (display (' a))
+display     a
+value       a
+
+End of LISP Run
+
+Calls to eval = 12
+Calls to cons = 729
+`
+
+func TestParseTranscript(t *testing.T) {
+	tr := ParseTranscript([]byte(sampleTranscript))
+	if want := []string{"LISP Interpreter Run"}; !reflect.DeepEqual(tr.Header, want) {
+		t.Errorf("Header = %q, want %q", tr.Header, want)
+	}
+	if want := []string{"End of LISP Run", "", "Calls to eval = 12", "Calls to cons = 729"}; !reflect.DeepEqual(tr.Trailer, want) {
+		t.Errorf("Trailer = %q, want %q", tr.Trailer, want)
+	}
+	want := []struct {
+		line    int
+		source  string
+		title   string
+		records []Record
+	}{
+		{2, "[ a comment ] define (f x) cons x nil", "define f", []Record{
+			{7, "define", "f"},
+			{8, "value", "(lambda (x) (cons x nil))"},
+		}},
+		{9, "(f '(a b c d e f g h i j k l m n o p q r s t u v w x y z))", "expression (f (' (a b c d e f g h i j k l m n o p q r s t u v w x y z)))", []Record{
+			{12, "expression", "(f (' (a b c d e f g h i j k l m n o p q r s t u v w x y z)))"},
+			{14, "value", "((a b c d e f g h i j k l m n o p q r s t u v w x y z))"},
+		}},
+		{16, "display 'a", "expression (display (' a))", []Record{
+			{19, "expression", "(display (' a))"},
+			{20, "display", "a"},
+			{21, "value", "a"},
+		}},
+	}
+	if len(tr.Forms) != len(want) {
+		t.Fatalf("got %d forms, want %d", len(tr.Forms), len(want))
+	}
+	for i, w := range want {
+		f := tr.Forms[i]
+		if f.Line != w.line {
+			t.Errorf("form %d: Line = %d, want %d", i, f.Line, w.line)
+		}
+		if got := f.Source(); got != w.source {
+			t.Errorf("form %d: Source() = %q, want %q", i, got, w.source)
+		}
+		if got := f.Title(); got != w.title {
+			t.Errorf("form %d: Title() = %q, want %q", i, got, w.title)
+		}
+		if !reflect.DeepEqual(f.Records, w.records) {
+			t.Errorf("form %d: Records = %v, want %v", i, f.Records, w.records)
+		}
+	}
+}
+
+func TestNormalSexp(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"a", "a"},
+		{"()", "()"},
+		{"(a b c)", "(a b c)"},
+		{"( a  b\n c )", "(a b c)"},
+		{"((a)(b))", "((a) (b))"},
+		{"(' (a b))", "(' (a b))"},
+		{"(a b c d e f g h i j\n            k)", "(a b c d e f g h i j k)"},
+	}
+	for _, tt := range tests {
+		if got := NormalSexp(tt.in); got != tt.want {
+			t.Errorf("NormalSexp(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if !SameSexp("(a (b) c)", "(a(b)c)") {
+		t.Errorf("SameSexp of two spacings is false")
+	}
+	if SameSexp("(a b)", "(a (b))") {
+		t.Errorf("SameSexp of different lists is true")
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b, want []string
+	}{
+		{nil, nil, nil},
+		{[]string{"a", "b"}, []string{"a", "b"}, nil},
+		{[]string{"a", "b", "c"}, []string{"a", "c"}, []string{"- b"}},
+		{[]string{"a", "c"}, []string{"a", "b", "c"}, []string{"+ b"}},
+		{[]string{"a", "b"}, []string{"a", "x"}, []string{"- b", "+ x"}},
+	}
+	for _, tt := range tests {
+		if got := diffLines(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("diffLines(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
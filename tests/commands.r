@@ -0,0 +1,140 @@
+LISP Interpreter Run
+
+[[[ The names of the top-level commands are ordinary symbols anywhere but
+    at the start of a top-level form. ]]]
+
+[ f makes a list of its argument ]
+define (f heap) cons heap nil
+
+define      f
+value       (lambda (heap) (cons heap nil))
+
+(f 3)
+
+expression  (f 3)
+value       (3)
+
+define (g doc arity) cons doc cons arity nil
+
+define      g
+value       (lambda (doc arity) (cons doc (cons arity nil)))
+
+(g 1 2)
+
+expression  (g 1 2)
+value       (1 2)
+
+define (h trace break untrace unbreak) cons trace cons break cons untrace cons unbreak nil
+
+define      h
+value       (lambda (trace break untrace unbreak) (cons trace 
+            (cons break (cons untrace (cons unbreak nil)))))
+
+(h a b c d)
+
+expression  (h a b c d)
+value       (a b c d)
+
+'(trace break doc)
+
+expression  (' (trace break doc))
+value       (trace break doc)
+
+'(arity heap untrace unbreak)
+
+expression  (' (arity heap untrace unbreak))
+value       (arity heap untrace unbreak)
+
+car '(heap)
+
+expression  (car (' (heap)))
+value       heap
+
+cons doc cons trace nil
+
+expression  (cons doc (cons trace nil))
+value       (doc trace)
+
+let (k doc) cons doc nil
+(k x)
+
+expression  ((' (lambda (k) (k x))) (' (lambda (doc) (cons doc
+             nil))))
+value       (x)
+
+let heap '(1 2 3) length heap
+
+expression  ((' (lambda (heap) (length heap))) (' (1 2 3)))
+value       3
+
+atom 'doc
+
+expression  (atom (' doc))
+value       true
+
+"heap
+
+expression  heap
+value       heap
+
+
+[ Functions named like commands are called in list form. ]
+define (doc x) cons x nil
+
+define      doc
+value       (lambda (x) (cons x nil))
+
+(doc 5)
+
+expression  (doc 5)
+value       (5)
+
+define (heap n) cons n cons n nil
+
+define      heap
+value       (lambda (n) (cons n (cons n nil)))
+
+(heap 7)
+
+expression  (heap 7)
+value       (7 7)
+
+
+[ The commands still work at the start of a form. ]
+doc f
+
+doc         f
+comment     f makes a list of its argument
+
+arity g 2
+
+arity       g
+value       2
+
+g 1 g 2 3
+
+expression  (g 1 (g 2 3))
+value       (1 (2 3))
+
+trace f
+
+trace       f
+
+(f 4)
+
+expression  (f 4)
+value       (4)
+
+untrace f
+
+untrace     f
+
+(f 5)
+
+expression  (f 5)
+value       (5)
+
+End of LISP Run
+
+Calls to eval = 129
+Calls to cons = 2434